@@ -1,6 +1,7 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
 	"github.com/danielpanteleit/local-btrfs/daemon"
 	"github.com/docker/go-plugins-helpers/volume"
@@ -10,77 +11,318 @@ import (
 	"net/http"
 	"net/rpc"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 var (
-	app = kingpin.New("local-btrfs", "")
+	app        = kingpin.New("local-btrfs", "")
+	outputFlag = app.Flag("output", "Output format of client commands").Short('o').Default(outputPlain).Enum(outputPlain, outputTable, outputJson)
+	configFlag = app.Flag("config", "Config file, "+daemon.DefaultConfigFile+" if it exists").Envar("LOCAL_BTRFS_CONFIG").String()
+	socketFlag = app.Flag("socket", "Unix socket of the RPC API").Envar("LOCAL_BTRFS_SOCKET").String()
 
-	daemonCmd = app.Command("daemon", "Starts the daemon.")
+	daemonCmd           = app.Command("daemon", "Starts the daemon.")
+	daemonSchedulerFlag = daemonCmd.Flag("scheduler", "Takes scheduled snapshots of volumes created with a snapshot_interval").Default("true").Bool()
+	daemonRecoverFlag   = daemonCmd.Flag("recover-root", "Registers volumes found below this directory on startup").String()
+	daemonPluginFlag    = daemonCmd.Flag("plugin-name", "Name of the volume driver in docker").Envar("LOCAL_BTRFS_PLUGIN_NAME").String()
+	daemonStateDirFlag  = daemonCmd.Flag("state-dir", "Directory of the state file").Envar("LOCAL_BTRFS_STATE_DIR").String()
+	daemonStateFileFlag = daemonCmd.Flag("state-file", "Name of the state file").Envar("LOCAL_BTRFS_STATE_FILE").String()
+	daemonRootFlag      = daemonCmd.Flag("default-root", "Directory for volumes created without mountpoint").Envar("LOCAL_BTRFS_DEFAULT_ROOT").String()
+	daemonLogLevelFlag  = daemonCmd.Flag("log-level", "One of debug, info, warn, error").Envar("LOCAL_BTRFS_LOG_LEVEL").String()
+	daemonLogFormatFlag = daemonCmd.Flag("log-format", "One of text, json").Envar("LOCAL_BTRFS_LOG_FORMAT").String()
+	daemonBackendFlag   = daemonCmd.Flag("backend", "Performs the btrfs operations, exec, ioctl or fake (for tests)").Envar("LOCAL_BTRFS_BACKEND").String()
+	daemonMetricsFlag   = daemonCmd.Flag("metrics-listen", "Address to serve Prometheus metrics on, e.g. :9410").Envar("LOCAL_BTRFS_METRICS_LISTEN").String()
+	daemonListSnapsFlag = daemonCmd.Flag("list-snapshots", "Lists snapshots as read-only volumes named <volume>@<snapshot>").Envar("LOCAL_BTRFS_LIST_SNAPSHOTS").Bool()
 
 	addCmd       = app.Command("add", "Adds a volume")
 	addArgVolume = addCmd.Arg("volume", "").Required().String()
-	addArgPath   = addCmd.Arg("path", "").Required().String()
+	addArgPath   = addCmd.Arg("path", "Defaults to a directory named after the volume in the root").String()
+	addRootFlag  = addCmd.Flag("root", "Name of the configured root to create the volume in").String()
+	addSizeFlag  = addCmd.Flag("size", "Limits the size of the volume, e.g. 10G").String()
+
+	cloneCmd          = app.Command("clone", "Creates a writable volume from a snapshot")
+	cloneArgSrcVolume = cloneCmd.Arg("src-volume", "").Required().String()
+	cloneArgSnapshot  = cloneCmd.Arg("snapshot", "").Required().String()
+	cloneArgVolume    = cloneCmd.Arg("volume", "").Required().String()
+	cloneArgPath      = cloneCmd.Arg("path", "Defaults to a directory named after the volume in the root").String()
+	cloneRootFlag     = cloneCmd.Flag("root", "Name of the configured root to create the volume in").String()
+
+	resizeCmd       = app.Command("resize", "Changes the size limit of a volume")
+	resizeArgVolume = resizeCmd.Arg("volume", "").Required().String()
+	resizeArgSize   = resizeCmd.Arg("size", "New size limit, e.g. 10G, or none").Required().String()
 
 	rmCmd       = app.Command("rm", "Removes volume")
-	rmForceFlag = rmCmd.Flag("purge", "Removes the volume on disk").Short('p').Bool()
+	rmPurgeFlag = rmCmd.Flag("purge", "Removes the volume on disk").Short('p').Bool()
+	rmForceFlag = rmCmd.Flag("force", "Purges the volume even if it is in use").Short('f').Bool()
 	rmArgVolume = rmCmd.Arg("volume", "").Required().String()
 
-	pathCmd = app.Command("path", "Shows path to the volume")
+	clearMountsCmd       = app.Command("clear-mounts", "Forgets the mounts of a volume docker didn't unmount, e.g. after it crashed. Only use it if no container is using the volume")
+	clearMountsArgVolume = clearMountsCmd.Arg("volume", "").Required().String()
+
+	pathCmd       = app.Command("path", "Shows path to the volume")
+	pathArgVolume = pathCmd.Arg("volume", "").Required().String()
+
+	lsCmd = app.Command("ls", "Lists volumes")
+
+	inspectCmd       = app.Command("inspect", "Shows details of a volume").Alias("info")
+	inspectArgVolume = inspectCmd.Arg("volume", "").Required().String()
+
+	recoverCmd        = app.Command("recover", "Rebuilds the daemon state from the volumes found on disk")
+	recoverRootFlag   = recoverCmd.Flag("root", "Directory to scan for volumes").Required().String()
+	recoverDryRunFlag = recoverCmd.Flag("dry-run", "Only reports differences").Bool()
+
+	volumeCmd = app.Command("volume", "Manages volumes")
+
+	volumeImportCmd       = volumeCmd.Command("import", "Imports a snapshot file as new volume")
+	volumeImportArgVolume = volumeImportCmd.Arg("volume", "").Required().String()
+	volumeImportArgPath   = volumeImportCmd.Arg("path", "").Required().String()
+	volumeImportArgFile   = volumeImportCmd.Arg("file", "").Required().String()
 
 	snapCmd = app.Command("snap", "Manages snapshots")
 
 	snapAddCmd       = snapCmd.Command("add", "")
+	snapAddMessage   = snapAddCmd.Flag("message", "Description of the snapshot").Short('m').String()
+	snapAddLabels    = snapAddCmd.Flag("label", "Label of the snapshot as key=value, can be repeated").Short('l').Strings()
+	snapAddGroup     = snapAddCmd.Flag("group", "Snapshots all given volumes together as group, the last argument is the name").Short('g').String()
 	snapAddArgVolume = snapAddCmd.Arg("volume", "").Required().String()
 	snapAddArgName   = snapAddCmd.Arg("name", "").Required().String()
+	snapAddArgMore   = snapAddCmd.Arg("more", "More volumes and the name with --group").Strings()
 
-	snapLsCmd       = snapCmd.Command("ls", "")
-	snapLsArgVolume = snapLsCmd.Arg("volume", "").Required().String()
+	snapLsCmd         = snapCmd.Command("ls", "")
+	snapLsSinceFlag   = snapLsCmd.Flag("since", "Only snapshots created since, as RFC 3339 time or duration ago, e.g. 24h").String()
+	snapLsUntilFlag   = snapLsCmd.Flag("until", "Only snapshots created until, as RFC 3339 time or duration ago").String()
+	snapLsLabelFlag   = snapLsCmd.Flag("label", "Only snapshots with the label key=value, can be repeated").Short('l').Strings()
+	snapLsSortFlag    = snapLsCmd.Flag("sort", "Sorts by name or created").Default("name").Enum("name", "created")
+	snapLsReverseFlag = snapLsCmd.Flag("reverse", "Reverses the order").Short('r').Bool()
+	snapLsArgVolume   = snapLsCmd.Arg("volume", "").Required().String()
 
 	snapRmCmd       = snapCmd.Command("rm", "")
 	snapRmArgVolume = snapRmCmd.Arg("volume", "").Required().String()
 	snapRmArgName   = snapRmCmd.Arg("name", "").Required().String()
 
+	snapDiffCmd       = snapCmd.Command("diff", "Lists the paths changed between two snapshots")
+	snapDiffArgVolume = snapDiffCmd.Arg("volume", "").Required().String()
+	snapDiffArgFrom   = snapDiffCmd.Arg("from", "").Required().String()
+	snapDiffArgTo     = snapDiffCmd.Arg("to", "Snapshot or current").Default("current").String()
+
 	snapRestoreCmd       = snapCmd.Command("restore", "")
-	snapRestoreArgVolume = snapRestoreCmd.Arg("volume", "").Required().String()
-	snapRestoreArgName   = snapRestoreCmd.Arg("name", "").Required().String()
+	snapRestoreForceFlag = snapRestoreCmd.Flag("force", "Restores the snapshot even if the volume is in use").Short('f').Bool()
+	snapRestoreNoBackup  = snapRestoreCmd.Flag("no-backup", "Discards the previous state instead of keeping it as pre-restore snapshot").Bool()
+	snapRestoreGroup     = snapRestoreCmd.Flag("group", "Restores all volumes of the group snapshot, which is the only argument").Short('g').String()
+	snapRestoreArgVolume = snapRestoreCmd.Arg("volume", "Omitted with --group").Required().String()
+	snapRestoreArgName   = snapRestoreCmd.Arg("name", "").String()
+
+	snapRestorePathCmd       = snapCmd.Command("restore-path", "Copies a file or directory from a snapshot into the volume")
+	snapRestorePathToFlag    = snapRestorePathCmd.Flag("to", "Destination path in the volume, defaults to the path").String()
+	snapRestorePathOverwrite = snapRestorePathCmd.Flag("overwrite", "Replaces an existing destination").Bool()
+	snapRestorePathArgVolume = snapRestorePathCmd.Arg("volume", "").Required().String()
+	snapRestorePathArgName   = snapRestorePathCmd.Arg("name", "").Required().String()
+	snapRestorePathArgPath   = snapRestorePathCmd.Arg("path", "Path in the volume").Required().String()
+
+	snapBrowseCmd       = snapCmd.Command("browse", "Lists a directory of a snapshot")
+	snapBrowseArgVolume = snapBrowseCmd.Arg("volume", "").Required().String()
+	snapBrowseArgName   = snapBrowseCmd.Arg("name", "").Required().String()
+	snapBrowseArgPath   = snapBrowseCmd.Arg("path", "Path in the volume").Default("/").String()
+
+	snapSendCmd          = snapCmd.Command("send", "Sends a snapshot to another btrfs filesystem")
+	snapSendArgVolume    = snapSendCmd.Arg("volume", "").Required().String()
+	snapSendArgName      = snapSendCmd.Arg("name", "").Required().String()
+	snapSendArgTargetDir = snapSendCmd.Arg("target-dir", "").Required().String()
+
+	snapExportCmd          = snapCmd.Command("export", "Exports a snapshot as btrfs send stream file")
+	snapExportCompressFlag = snapExportCmd.Flag("compress", "Compresses the file with gzip").Short('z').Bool()
+	snapExportArgVolume    = snapExportCmd.Arg("volume", "").Required().String()
+	snapExportArgName      = snapExportCmd.Arg("name", "").Required().String()
+	snapExportArgFile      = snapExportCmd.Arg("file", "").Required().String()
+
+	snapImportCmd       = snapCmd.Command("import", "Imports a snapshot file as additional snapshot")
+	snapImportArgVolume = snapImportCmd.Arg("volume", "").Required().String()
+	snapImportArgFile   = snapImportCmd.Arg("file", "").Required().String()
+	snapImportArgName   = snapImportCmd.Arg("name", "Defaults to the name of the exported snapshot").String()
 )
 
 func Main() {
-	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
-	case daemonCmd.FullCommand():
+	command := kingpin.MustParse(app.Parse(os.Args[1:]))
+	config = loadConfig()
+
+	if command == daemonCmd.FullCommand() {
 		runDaemon()
+		return
+	}
+	if err := runClient(command); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runClient runs the client command against the daemon.
+func runClient(command string) error {
+	switch command {
 	case addCmd.FullCommand():
-		clientHandler(daemon.CreateVolumeRequest(*addArgVolume, *addArgPath))
+		return clientHandler(daemon.CreateVolumeRequest(*addArgVolume, absPath(*addArgPath), *addRootFlag, *addSizeFlag))
+	case cloneCmd.FullCommand():
+		return clientHandler(daemon.CloneVolumeRequest(*cloneArgSrcVolume, *cloneArgSnapshot, *cloneArgVolume, absPath(*cloneArgPath), *cloneRootFlag))
+	case resizeCmd.FullCommand():
+		return clientHandler(daemon.ResizeVolumeRequest(*resizeArgVolume, *resizeArgSize))
 	case rmCmd.FullCommand():
-		clientHandler(daemon.RemoveVolumeRequest(*rmArgVolume, *rmForceFlag))
+		return clientHandler(daemon.RemoveVolumeRequest(*rmArgVolume, *rmPurgeFlag, *rmForceFlag))
+	case recoverCmd.FullCommand():
+		return clientHandler(daemon.RecoverRequest(absPath(*recoverRootFlag), *recoverDryRunFlag))
+	case volumeImportCmd.FullCommand():
+		return clientHandler(daemon.ImportVolumeRequest(*volumeImportArgVolume, absPath(*volumeImportArgPath), absPath(*volumeImportArgFile)))
+	case clearMountsCmd.FullCommand():
+		return clientHandler(daemon.ClearMountsRequest(*clearMountsArgVolume))
+	case inspectCmd.FullCommand():
+		return clientHandler(daemon.VolumeInfoRequest(*inspectArgVolume))
+	case lsCmd.FullCommand():
+		return clientHandler(daemon.ListVolumesRequest())
 	case pathCmd.FullCommand():
-		fmt.Printf("not implemented yet!\n")
+		return clientHandler(daemon.VolumePathRequest(*pathArgVolume))
 	case snapAddCmd.FullCommand():
-		clientHandler(daemon.CreateSnapRequest(*snapAddArgVolume, *snapAddArgName))
+		if *snapAddGroup != "" {
+			// the name is the last argument, all before are volumes
+			args := append([]string{*snapAddArgVolume, *snapAddArgName}, *snapAddArgMore...)
+			volumes, name := args[:len(args)-1], args[len(args)-1]
+			return clientHandler(daemon.CreateGroupSnapRequest(*snapAddGroup, volumes, name, *snapAddMessage, *snapAddLabels))
+		} else if len(*snapAddArgMore) > 0 {
+			app.Fatalf("snapshots of several volumes require --group")
+		} else {
+			return clientHandler(daemon.CreateSnapRequest(*snapAddArgVolume, *snapAddArgName, *snapAddMessage, *snapAddLabels))
+		}
 	case snapLsCmd.FullCommand():
-		clientHandler(daemon.ListSnapshotsRequest(*snapLsArgVolume))
+		since, until := parseTimeFlag(*snapLsSinceFlag), parseTimeFlag(*snapLsUntilFlag)
+		return clientHandler(daemon.ListSnapshotsRequest(*snapLsArgVolume, since, until, *snapLsLabelFlag, *snapLsSortFlag, *snapLsReverseFlag))
 	case snapRmCmd.FullCommand():
-		clientHandler(daemon.RemoveSnapRequest(*snapRmArgVolume, *snapRmArgName))
+		return clientHandler(daemon.RemoveSnapRequest(*snapRmArgVolume, *snapRmArgName))
+	case snapDiffCmd.FullCommand():
+		return clientHandler(daemon.DiffSnapsRequest(*snapDiffArgVolume, *snapDiffArgFrom, *snapDiffArgTo))
 	case snapRestoreCmd.FullCommand():
-		clientHandler(daemon.RestoreSnapRequest(*snapRestoreArgVolume, *snapRestoreArgName))
+		if *snapRestoreGroup != "" {
+			// the only argument is the name of the group snapshot
+			if *snapRestoreArgName != "" {
+				app.Fatalf("group restores only take the name of the snapshot")
+			}
+			return clientHandler(daemon.RestoreGroupSnapRequest(*snapRestoreGroup, *snapRestoreArgVolume, *snapRestoreForceFlag, *snapRestoreNoBackup))
+		} else if *snapRestoreArgName == "" {
+			app.Fatalf("required argument 'name' not provided")
+		} else {
+			return clientHandler(daemon.RestoreSnapRequest(*snapRestoreArgVolume, *snapRestoreArgName, *snapRestoreForceFlag, *snapRestoreNoBackup))
+		}
+	case snapRestorePathCmd.FullCommand():
+		return clientHandler(daemon.RestorePathRequest(*snapRestorePathArgVolume, *snapRestorePathArgName, *snapRestorePathArgPath, *snapRestorePathToFlag, *snapRestorePathOverwrite))
+	case snapBrowseCmd.FullCommand():
+		return clientHandler(daemon.BrowseSnapRequest(*snapBrowseArgVolume, *snapBrowseArgName, *snapBrowseArgPath))
+	case snapSendCmd.FullCommand():
+		return clientHandler(daemon.SendSnapRequest(*snapSendArgVolume, *snapSendArgName, absPath(*snapSendArgTargetDir)))
+	case snapExportCmd.FullCommand():
+		return clientHandler(daemon.ExportSnapRequest(*snapExportArgVolume, *snapExportArgName, absPath(*snapExportArgFile), *snapExportCompressFlag))
+	case snapImportCmd.FullCommand():
+		return clientHandler(daemon.ImportSnapRequest(*snapImportArgVolume, absPath(*snapImportArgFile), *snapImportArgName))
 	}
+	return nil
+}
+
+// parseTimeFlag parses an RFC 3339 time or a duration before now, returning
+// nil for "".
+func parseTimeFlag(value string) *time.Time {
+	if value == "" {
+		return nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return &t
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		app.Fatalf("invalid time %q, must be RFC 3339 time or duration", value)
+	}
+	t := time.Now().Add(-d)
+	return &t
+}
+
+// config is read once on startup, from the config file and the flags.
+var config daemon.Config
+
+// loadConfig reads the config file and overrides its settings with the ones
+// given as flag or environment variable.
+func loadConfig() daemon.Config {
+	configFile, required := *configFlag, true
+	if configFile == "" {
+		configFile, required = daemon.DefaultConfigFile, false
+	}
+
+	config, err := daemon.LoadConfig(configFile, required)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	overrides := map[*string]string{
+		&config.Socket:        *socketFlag,
+		&config.PluginName:    *daemonPluginFlag,
+		&config.StateDir:      *daemonStateDirFlag,
+		&config.StateFile:     *daemonStateFileFlag,
+		&config.DefaultRoot:   *daemonRootFlag,
+		&config.LogLevel:      *daemonLogLevelFlag,
+		&config.LogFormat:     *daemonLogFormatFlag,
+		&config.Backend:       *daemonBackendFlag,
+		&config.MetricsListen: *daemonMetricsFlag,
+	}
+	for setting, value := range overrides {
+		if value != "" {
+			*setting = value
+		}
+	}
+	if *daemonListSnapsFlag {
+		config.ListSnapshots = true
+	}
+
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	return config
 }
 
 func runDaemon() {
-	driver := daemon.NewLocalBtrfsDriver()
+	driver := startDaemon()
+	handler := volume.NewHandler(daemon.InstrumentDriver(driver))
+	fmt.Println(handler.ServeUnix(driver.Name, 0))
+}
+
+// startDaemon starts everything of the daemon but the plugin API, which
+// docker calls.
+func startDaemon() daemon.LocalBtrfsDriver {
+	if err := daemon.SetupLogging(config); err != nil {
+		log.Fatal(err)
+	}
+
+	driver := daemon.NewLocalBtrfsDriver(config)
+
+	if *daemonRecoverFlag != "" {
+		report, err := driver.Recover(*daemonRecoverFlag, false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printReply(&report, outputPlain)
+	}
 
 	setupRpcHandler(driver)
+	if config.MetricsListen != "" {
+		setupMetricsHandler(driver)
+	}
 
-	handler := volume.NewHandler(driver)
-	fmt.Println(handler.ServeUnix(driver.Name, 0))
+	if *daemonSchedulerFlag {
+		driver.StartScheduler(time.Minute)
+	}
+	return driver
 }
 
 func setupRpcHandler(driver daemon.LocalBtrfsDriver) {
 	rpcApi := daemon.RpcApi{Driver: driver}
-	rpc.Register(rpcApi)
+	rpc.RegisterName(daemon.RpcServiceName, rpcApi)
+	rpc.RegisterName("RpcApi", daemon.LegacyRpcApi{})
 	rpc.HandleHTTP()
 
-	sockFile := "/var/run/local-btrfs.sock"
+	sockFile := config.Socket
 	l, e := net.Listen("unix", sockFile)
 	if e != nil {
 		log.Fatal("listen error:", e)
@@ -93,15 +335,57 @@ func setupRpcHandler(driver daemon.LocalBtrfsDriver) {
 	go http.Serve(l, nil)
 }
 
-func clientHandler(request daemon.RpcApiRequest) {
-	client, err := rpc.DialHTTP("unix", "/var/run/local-btrfs.sock")
+// setupMetricsHandler serves the metrics on their own mux, the default mux
+// serves the RPC API, which must not be reachable over the network.
+func setupMetricsHandler(driver daemon.LocalBtrfsDriver) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", driver.MetricsHandler())
+
+	l, err := net.Listen("tcp", config.MetricsListen)
+	if err != nil {
+		log.Fatal("listen error:", err)
+	}
+	go http.Serve(l, mux)
+}
+
+func clientHandler(request daemon.RpcApiRequest) error {
+	if err := callDaemon(request); err != nil {
+		return err
+	}
+	printReply(request.Reply, *outputFlag)
+	return nil
+}
+
+func callDaemon(request daemon.RpcApiRequest) error {
+	client, err := rpc.DialHTTP("unix", config.Socket)
 	if err != nil {
 		log.Fatal("dialing:", err)
 	}
+	defer client.Close()
 
-	result := new(string)
-	if err := client.Call(request.Method, &request.Args, &result); err != nil {
-		fmt.Printf("error: %v\n", err)
+	handshake := daemon.HandshakeRequest()
+	if err := client.Call(handshake.Method, handshake.Args, handshake.Reply); err != nil {
+		if strings.Contains(err.Error(), "can't find service") {
+			return errors.New(fmt.Sprintf("the daemon is too old for this CLI (protocol version %d), please update it", daemon.ProtocolVersion))
+		}
+		return err
+	}
+	if err := daemon.CheckProtocolVersion(*handshake.Reply.(*daemon.HandshakeReply)); err != nil {
+		return err
+	}
+
+	return client.Call(request.Method, request.Args, request.Reply)
+}
+
+// absPath makes file arguments independent of the working directory of the
+// daemon. Omitted optional paths stay empty.
+func absPath(file string) string {
+	if file == "" {
+		return ""
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		log.Fatal(err)
 	}
-	fmt.Print(*result)
+	return abs
 }
@@ -0,0 +1,146 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// testDir holds the socket, state and volumes of the test daemon, which uses
+// the fake backend, so the tests run without root and btrfs.
+var testDir string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "local-btrfs-cli")
+	if err != nil {
+		panic(err)
+	}
+	testDir = dir
+
+	// the RPC API is registered on the default mux, so there is one daemon
+	// for all tests
+	if _, err := app.Parse(append(socketArgs(), "daemon", "--backend", "fake", "--no-scheduler",
+		"--state-dir", path.Join(dir, "state"), "--default-root", path.Join(dir, "volumes"), "--log-level", "error")); err != nil {
+		panic(err)
+	}
+	config = loadConfig()
+	startDaemon()
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func socketArgs() []string {
+	return []string{"--socket", path.Join(testDir, "local-btrfs.sock")}
+}
+
+// runCli runs the client command given by args against the test daemon and
+// returns its output.
+func runCli(t *testing.T, args ...string) (string, error) {
+	command, err := app.Parse(append(socketArgs(), args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = loadConfig()
+
+	var out bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	err = runClient(command)
+	return out.String(), err
+}
+
+func mustRunCli(t *testing.T, args ...string) string {
+	out, err := runCli(t, args...)
+	if err != nil {
+		t.Fatalf("%v failed: %v", args, err)
+	}
+	return out
+}
+
+// runCliJson runs the command with JSON output and decodes it into v.
+func runCliJson(t *testing.T, v interface{}, args ...string) string {
+	out := mustRunCli(t, append([]string{"--output", "json"}, args...)...)
+	if err := json.Unmarshal([]byte(out), v); err != nil {
+		t.Fatalf("%v returned invalid JSON %q: %v", args, out, err)
+	}
+	return out
+}
+
+func TestVolumeLifecycle(t *testing.T) {
+	var volumes struct{ Volumes []map[string]interface{} }
+	out := runCliJson(t, &volumes, "ls")
+	if !strings.Contains(out, `"Volumes": []`) || len(volumes.Volumes) != 0 {
+		t.Fatalf("Expected an empty list, got %v", out)
+	}
+
+	mustRunCli(t, "add", "data")
+	if _, err := runCli(t, "add", "data"); err == nil {
+		t.Error("Expected error for existing volume")
+	}
+	if out := mustRunCli(t, "ls"); !strings.Contains(out, "data") {
+		t.Errorf("Expected the volume in %q", out)
+	}
+	runCliJson(t, &volumes, "ls")
+	if len(volumes.Volumes) != 1 || volumes.Volumes[0]["Name"] != "data" || volumes.Volumes[0]["Mountpoint"] != path.Join(testDir, "volumes", "data") {
+		t.Errorf("Unexpected volumes %+v", volumes.Volumes)
+	}
+
+	currentPath := strings.TrimSpace(mustRunCli(t, "path", "data"))
+	if currentPath != path.Join(testDir, "volumes", "data", "current") {
+		t.Errorf("Unexpected path %q", currentPath)
+	}
+
+	mustRunCli(t, "rm", "--purge", "data")
+	runCliJson(t, &volumes, "ls")
+	if len(volumes.Volumes) != 0 {
+		t.Errorf("Expected no volumes after rm, got %+v", volumes.Volumes)
+	}
+	if _, err := os.Stat(path.Join(testDir, "volumes", "data")); !os.IsNotExist(err) {
+		t.Error("Expected the volume to be purged:", err)
+	}
+}
+
+func TestSnapshotLifecycle(t *testing.T) {
+	mustRunCli(t, "add", "snaps")
+	defer mustRunCli(t, "rm", "--purge", "snaps")
+
+	var snaps struct{ Snapshots []map[string]interface{} }
+	out := runCliJson(t, &snaps, "snap", "ls", "snaps")
+	if !strings.Contains(out, `"Snapshots": []`) || len(snaps.Snapshots) != 0 {
+		t.Fatalf("Expected an empty list, got %v", out)
+	}
+
+	file := path.Join(testDir, "volumes", "snaps", "current", "file")
+	ioutil.WriteFile(file, []byte("before"), 0644)
+	mustRunCli(t, "snap", "add", "--message", "first", "snaps", "snap1")
+	ioutil.WriteFile(file, []byte("after"), 0644)
+
+	runCliJson(t, &snaps, "snap", "ls", "snaps")
+	if len(snaps.Snapshots) != 1 || snaps.Snapshots[0]["Name"] != "snap1" || snaps.Snapshots[0]["Description"] != "first" {
+		t.Fatalf("Unexpected snapshots %+v", snaps.Snapshots)
+	}
+	if out := mustRunCli(t, "snap", "ls", "snaps"); !strings.Contains(out, "snap1") {
+		t.Errorf("Expected the snapshot in %q", out)
+	}
+
+	mustRunCli(t, "snap", "restore", "--no-backup", "snaps", "snap1")
+	if content, _ := ioutil.ReadFile(file); string(content) != "before" {
+		t.Errorf("Expected the restored content, got %q", content)
+	}
+
+	if _, err := runCli(t, "snap", "add", "missing", "snap1"); err == nil {
+		t.Error("Expected error for unknown volume")
+	}
+
+	mustRunCli(t, "snap", "rm", "snaps", "snap1")
+	runCliJson(t, &snaps, "snap", "ls", "snaps")
+	if len(snaps.Snapshots) != 0 {
+		t.Errorf("Expected no snapshots after rm, got %+v", snaps.Snapshots)
+	}
+}
@@ -0,0 +1,252 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/danielpanteleit/local-btrfs/daemon"
+)
+
+const (
+	outputPlain = "plain"
+	outputTable = "table"
+	outputJson  = "json"
+)
+
+// stdout receives the output of client commands, it's replaced in tests.
+var stdout io.Writer = os.Stdout
+
+// printReply prints the reply of a daemon call in the given output format.
+// JSON output contains the reply structs as they are, so scripts get the
+// same fields as the RPC API.
+func printReply(reply interface{}, format string) {
+	if format == outputJson {
+		printJson(stdout, normalizeReply(reply))
+		return
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	switch r := reply.(type) {
+	case *daemon.SnapshotList:
+		printSnapshots(w, r.Snapshots, format)
+	case *daemon.VolumeList:
+		printVolumes(w, r.Volumes, format)
+	case *daemon.VolumeInfo:
+		printVolumeInfo(w, r)
+	case *daemon.PathReply:
+		fmt.Fprintln(w, r.Path)
+	case *daemon.RecoveryReport:
+		printRecoveryReport(w, r.Entries, format)
+	case *daemon.DiffReport:
+		printDiff(w, r.Entries, format)
+	case *daemon.BrowseReply:
+		printBrowse(w, r.Entries, format)
+	}
+}
+
+func printJson(w io.Writer, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintln(w, string(data))
+}
+
+// normalizeReply replaces nil slices, which gob transfers for empty ones,
+// so that JSON output always contains lists instead of null.
+func normalizeReply(reply interface{}) interface{} {
+	switch r := reply.(type) {
+	case *daemon.SnapshotList:
+		if r.Snapshots == nil {
+			r.Snapshots = []daemon.SnapshotInfo{}
+		}
+	case *daemon.VolumeList:
+		if r.Volumes == nil {
+			r.Volumes = []daemon.VolumeInfo{}
+		}
+	case *daemon.RecoveryReport:
+		if r.Entries == nil {
+			r.Entries = []daemon.RecoveryEntry{}
+		}
+	case *daemon.DiffReport:
+		if r.Entries == nil {
+			r.Entries = []daemon.DiffEntry{}
+		}
+	case *daemon.BrowseReply:
+		if r.Entries == nil {
+			r.Entries = []daemon.BrowseEntry{}
+		}
+	}
+	return reply
+}
+
+func printSnapshots(w io.Writer, snaps []daemon.SnapshotInfo, format string) {
+	if format == outputPlain {
+		for _, snap := range snaps {
+			fmt.Fprintln(w, snap.Name)
+		}
+		return
+	}
+
+	fmt.Fprintln(w, "NAME\tCREATED\tCREATOR\tGROUP\tREADONLY\tEXCLUSIVE\tPARENT\tLABELS\tDESCRIPTION")
+	for _, snap := range snaps {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\t%s\t%s\t%s\t%s\n", snap.Name, formatTime(snap.CreationTime), orDash(snap.Creator), orDash(snap.Group), snap.ReadOnly, formatBytes(snap.ExclusiveBytes), orDash(snap.ParentUUID), formatLabels(snap.Labels), orDash(snap.Description))
+	}
+}
+
+func printVolumes(w io.Writer, volumes []daemon.VolumeInfo, format string) {
+	if format == outputPlain {
+		for _, info := range volumes {
+			fmt.Fprintln(w, info.Name)
+		}
+		return
+	}
+
+	fmt.Fprintln(w, "NAME\tMOUNTPOINT\tEXISTS\tMOUNTS\tSNAPSHOTS\tREFERENCED")
+	for _, info := range volumes {
+		fmt.Fprintf(w, "%s\t%s\t%v\t%d\t%d\t%s\n", info.Name, info.Mountpoint, info.Exists, info.Mounts, info.Snapshots, formatBytes(info.ReferencedBytes))
+	}
+}
+
+func printRecoveryReport(w io.Writer, entries []daemon.RecoveryEntry, format string) {
+	if format == outputPlain {
+		for _, entry := range entries {
+			registered := ""
+			if entry.Registered {
+				registered = " (registered)"
+			}
+			fmt.Fprintf(w, "%s %s %s%s\n", entry.Status, entry.Volume, entry.Mountpoint, registered)
+		}
+		return
+	}
+
+	fmt.Fprintln(w, "STATUS\tNAME\tMOUNTPOINT\tREGISTERED")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\n", entry.Status, entry.Volume, entry.Mountpoint, entry.Registered)
+	}
+}
+
+// diffMarks are the change marks of plain diff output, like in `git status -s`.
+var diffMarks = map[string]string{
+	daemon.DiffAdded:    "A",
+	daemon.DiffModified: "M",
+	daemon.DiffDeleted:  "D",
+}
+
+func printDiff(w io.Writer, entries []daemon.DiffEntry, format string) {
+	if format == outputPlain {
+		for _, entry := range entries {
+			fmt.Fprintf(w, "%s %s %d\n", diffMarks[entry.Change], diffPath(entry), entry.Size)
+		}
+		return
+	}
+
+	fmt.Fprintln(w, "CHANGE\tPATH\tSIZE\tOLD SIZE")
+	for _, entry := range entries {
+		oldSize := "-"
+		if entry.Change == daemon.DiffModified {
+			oldSize = strconv.FormatInt(entry.OldSize, 10)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", entry.Change, diffPath(entry), entry.Size, oldSize)
+	}
+}
+
+// diffPath marks directories with a trailing slash.
+func diffPath(entry daemon.DiffEntry) string {
+	if entry.Dir {
+		return entry.Path + "/"
+	}
+	return entry.Path
+}
+
+func printBrowse(w io.Writer, entries []daemon.BrowseEntry, format string) {
+	if format == outputPlain {
+		for _, entry := range entries {
+			fmt.Fprintln(w, browseName(entry))
+		}
+		return
+	}
+
+	fmt.Fprintln(w, "MODE\tSIZE\tMODIFIED\tNAME")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", entry.Mode, entry.Size, formatTime(&entry.ModTime), browseName(entry))
+	}
+}
+
+// browseName marks directories with a trailing slash and shows symlink targets.
+func browseName(entry daemon.BrowseEntry) string {
+	switch {
+	case entry.Dir:
+		return entry.Name + "/"
+	case entry.Target != "":
+		return entry.Name + " -> " + entry.Target
+	}
+	return entry.Name
+}
+
+func printVolumeInfo(w io.Writer, info *daemon.VolumeInfo) {
+	fmt.Fprintf(w, "Name:\t%s\n", info.Name)
+	fmt.Fprintf(w, "Mountpoint:\t%s\n", info.Mountpoint)
+	fmt.Fprintf(w, "Current path:\t%s\n", info.CurrentPath)
+	fmt.Fprintf(w, "Snapshot directory:\t%s\n", info.SnapshotDir)
+	fmt.Fprintf(w, "Exists:\t%v\n", info.Exists)
+	fmt.Fprintf(w, "Subvolume ID:\t%d\n", info.SubvolumeID)
+	if info.CreationTime != nil {
+		fmt.Fprintf(w, "Creation time:\t%s\n", formatTime(info.CreationTime))
+	}
+	if info.ReferencedBytes != nil {
+		fmt.Fprintf(w, "Referenced bytes:\t%d\n", *info.ReferencedBytes)
+	}
+	if info.ExclusiveBytes != nil {
+		fmt.Fprintf(w, "Exclusive bytes:\t%d\n", *info.ExclusiveBytes)
+	}
+	fmt.Fprintf(w, "Mounts:\t%d\n", info.Mounts)
+	fmt.Fprintf(w, "Snapshots:\t%d\n", info.Snapshots)
+	if info.SizeLimit != 0 {
+		fmt.Fprintf(w, "Size limit:\t%d\n", info.SizeLimit)
+	}
+	if info.LatestSnapshot != "" {
+		fmt.Fprintf(w, "Latest snapshot:\t%s\n", info.LatestSnapshot)
+	}
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func formatBytes(b *uint64) string {
+	if b == nil {
+		return "-"
+	}
+	return strconv.FormatUint(*b, 10)
+}
+
+// formatLabels formats labels as comma separated key=value, sorted by key.
+func formatLabels(labels map[string]string) string {
+	var pairs []string
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return orDash(strings.Join(pairs, ","))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,142 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+// Subvolume describes a btrfs subvolume. UUIDs are "" if unset.
+type Subvolume struct {
+	ID           uint64
+	UUID         string
+	ParentUUID   string
+	ReceivedUUID string
+	Generation   int64
+	CreationTime *time.Time
+	ReadOnly     bool
+}
+
+// QgroupUsage are the sizes of the level 0 qgroup of a subvolume.
+type QgroupUsage struct {
+	Referenced uint64
+	Exclusive  uint64
+}
+
+// Backend performs the subvolume operations of the driver. Paths are
+// absolute paths of subvolumes or of directories on the btrfs filesystem.
+type Backend interface {
+	CreateSubvolume(path string) error
+	DeleteSubvolume(path string) error
+	SnapshotSubvolume(src string, dst string, readOnly bool) error
+	// ListSubvolumes returns the paths of all subvolumes below root.
+	ListSubvolumes(root string) ([]string, error)
+	ShowSubvolume(path string) (Subvolume, error)
+	// ShowSubvolumes returns the subvolumes directly in dir by name, like
+	// ShowSubvolume for each of them, but with a single listing. Details a
+	// backend can't list are left empty.
+	ShowSubvolumes(dir string) (map[string]Subvolume, error)
+
+	EnableQuota(path string) error
+	// LimitSubvolume limits the size of the subvolume, 0 removes the limit.
+	LimitSubvolume(path string, size uint64) error
+	// QgroupUsage returns the usage of all subvolumes of the filesystem by
+	// subvolume ID. It fails if quotas are disabled.
+	QgroupUsage(path string) (map[uint64]QgroupUsage, error)
+
+	// Send writes the send stream of the read-only snapshot at path to out,
+	// incremental to parent unless it is "".
+	Send(path string, parent string, out io.Writer) error
+	// Receive creates the subvolume of a send stream in dir.
+	Receive(in io.Reader, dir string) error
+}
+
+const (
+	backendExec  = "exec"
+	backendIoctl = "ioctl"
+	backendFake  = "fake"
+)
+
+var backendNames = []string{backendExec, backendIoctl, backendFake}
+
+func newBackend(name string) (Backend, error) {
+	switch name {
+	case backendExec:
+		return execBackend{}, nil
+	case backendIoctl:
+		return ioctlBackend{}, nil
+	case backendFake:
+		return newFakeBackend(), nil
+	}
+	return nil, errors.New(fmt.Sprintf("invalid backend %q, must be one of %v", name, backendNames))
+}
+
+// sendReceive sends the snapshot at path to dir, like `btrfs send | btrfs receive`.
+func sendReceive(backend Backend, path string, parent string, dir string) error {
+	r, w := io.Pipe()
+
+	sendErr := make(chan error, 1)
+	go func() {
+		err := backend.Send(path, parent, w)
+		w.CloseWithError(err)
+		sendErr <- err
+	}()
+
+	receiveErr := backend.Receive(r, dir)
+	// unblock the sender if receive stopped reading early
+	r.CloseWithError(io.ErrClosedPipe)
+
+	if err := <-sendErr; err != nil && err != io.ErrClosedPipe {
+		return err
+	}
+	return receiveErr
+}
+
+// subvolumesBelow returns the absolute paths of the subvolumes below root,
+// given their paths relative to the top level subvolume of the filesystem,
+// which isn't necessarily the mounted one.
+func subvolumesBelow(root string, relPaths []string) ([]string, error) {
+	relRoot, err := topLevelPath(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var subvolumes []string
+	for _, rel := range relPaths {
+		if relRoot != "" && !strings.HasPrefix(rel, relRoot+"/") {
+			continue
+		}
+		subvolumes = append(subvolumes, path.Join(root, strings.TrimPrefix(rel, relRoot)))
+	}
+	return subvolumes, nil
+}
+
+// topLevelPath returns the path of dir relative to the top level subvolume
+// of its filesystem, like the paths of `btrfs subvolume list`.
+func topLevelPath(dir string) (string, error) {
+	mountinfo, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	mnt, fsRoot, err := findMount(string(mountinfo), dir)
+	if err != nil {
+		return "", err
+	}
+	return strings.Trim(path.Join(fsRoot, strings.TrimPrefix(dir, mnt)), "/"), nil
+}
+
+// subvolumesIn returns the subvolumes directly in the directory with the
+// given path relative to the top level subvolume by name.
+func subvolumesIn(relDir string, subvolumes map[string]Subvolume) map[string]Subvolume {
+	found := map[string]Subvolume{}
+	for rel, subvolume := range subvolumes {
+		if path.Dir(rel) == path.Clean(relDir) {
+			found[path.Base(rel)] = subvolume
+		}
+	}
+	return found
+}
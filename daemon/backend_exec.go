@@ -0,0 +1,271 @@
+package daemon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const btrfsTimeFormat = "2006-01-02 15:04:05 -0700"
+
+// execBackend calls the btrfs command line tool.
+type execBackend struct{}
+
+func (execBackend) CreateSubvolume(path string) error {
+	return callBtrfs("subvolume", "create", path)
+}
+
+func (execBackend) DeleteSubvolume(path string) error {
+	return callBtrfs("subvolume", "delete", path)
+}
+
+func (execBackend) SnapshotSubvolume(src string, dst string, readOnly bool) error {
+	if readOnly {
+		return callBtrfs("subvolume", "snapshot", "-r", src, dst)
+	}
+	return callBtrfs("subvolume", "snapshot", src, dst)
+}
+
+func (execBackend) ListSubvolumes(root string) ([]string, error) {
+	output, err := callBtrfsOutput("subvolume", "list", root)
+	if err != nil {
+		return nil, err
+	}
+	return subvolumesBelow(root, parseSubvolumeList(output))
+}
+
+func (execBackend) ShowSubvolume(path string) (Subvolume, error) {
+	output, err := callBtrfsOutput("subvolume", "show", path)
+	if err != nil {
+		return Subvolume{}, err
+	}
+	return parseSubvolumeShow(output), nil
+}
+
+// ShowSubvolumes lists the subvolumes with their UUIDs, and once more only
+// the read-only ones, as `btrfs subvolume list` has no column for flags. The
+// creation time is only listed for snapshots, so it is left empty.
+func (execBackend) ShowSubvolumes(dir string) (map[string]Subvolume, error) {
+	relDir, err := topLevelPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	output, err := callBtrfsOutput("subvolume", "list", "-g", "-u", "-q", "-R", dir)
+	if err != nil {
+		return nil, err
+	}
+	readOnlyOutput, err := callBtrfsOutput("subvolume", "list", "-r", dir)
+	if err != nil {
+		return nil, err
+	}
+
+	subvolumes := parseSubvolumeListDetails(output)
+	for _, rel := range parseSubvolumeList(readOnlyOutput) {
+		if subvolume, ok := subvolumes[rel]; ok {
+			subvolume.ReadOnly = true
+			subvolumes[rel] = subvolume
+		}
+	}
+	return subvolumesIn(relDir, subvolumes), nil
+}
+
+func (execBackend) EnableQuota(path string) error {
+	return callBtrfs("quota", "enable", path)
+}
+
+func (execBackend) LimitSubvolume(path string, size uint64) error {
+	if size == 0 {
+		return callBtrfs("qgroup", "limit", "none", path)
+	}
+	return callBtrfs("qgroup", "limit", strconv.FormatUint(size, 10), path)
+}
+
+func (execBackend) QgroupUsage(path string) (map[uint64]QgroupUsage, error) {
+	output, err := callBtrfsOutput("qgroup", "show", "--raw", path)
+	if err != nil {
+		return nil, err
+	}
+	return parseQgroups(output)
+}
+
+func (execBackend) Send(path string, parent string, out io.Writer) error {
+	args := []string{"send"}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+	return callBtrfsStream(nil, out, append(args, path)...)
+}
+
+func (execBackend) Receive(in io.Reader, dir string) error {
+	return callBtrfsStream(in, nil, "receive", dir)
+}
+
+// parseSubvolumeShow parses the "key: value" lines of `btrfs subvolume show`.
+func parseSubvolumeShow(output string) Subvolume {
+	show := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		show[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	subvolume := Subvolume{
+		UUID:         btrfsUUID(show["UUID"]),
+		ParentUUID:   btrfsUUID(show["Parent UUID"]),
+		ReceivedUUID: btrfsUUID(show["Received UUID"]),
+		ReadOnly:     strings.Contains(show["Flags"], "readonly"),
+	}
+	if id, err := strconv.ParseUint(show["Subvolume ID"], 10, 64); err == nil {
+		subvolume.ID = id
+	}
+	if generation, err := strconv.ParseInt(show["Generation"], 10, 64); err == nil {
+		subvolume.Generation = generation
+	}
+	if created, err := time.Parse(btrfsTimeFormat, show["Creation time"]); err == nil {
+		subvolume.CreationTime = &created
+	}
+	return subvolume
+}
+
+// parseSubvolumeListDetails parses the output of
+// `btrfs subvolume list -g -u -q -R` into the subvolumes by their path
+// relative to the top level subvolume.
+func parseSubvolumeListDetails(output string) map[string]Subvolume {
+	subvolumes := map[string]Subvolume{}
+	for _, line := range strings.Split(output, "\n") {
+		i := strings.Index(line, " path ")
+		if i < 0 {
+			continue
+		}
+
+		subvolume := Subvolume{}
+		fields := strings.Fields(line[:i])
+		for j := 0; j+1 < len(fields); j++ {
+			value := fields[j+1]
+			switch fields[j] {
+			case "ID":
+				if id, err := strconv.ParseUint(value, 10, 64); err == nil {
+					subvolume.ID = id
+				}
+			case "gen":
+				if generation, err := strconv.ParseInt(value, 10, 64); err == nil {
+					subvolume.Generation = generation
+				}
+			case "uuid":
+				subvolume.UUID = btrfsUUID(value)
+			case "parent_uuid":
+				subvolume.ParentUUID = btrfsUUID(value)
+			case "received_uuid":
+				subvolume.ReceivedUUID = btrfsUUID(value)
+			}
+		}
+		subvolumes[strings.TrimPrefix(line[i+len(" path "):], "<FS_TREE>/")] = subvolume
+	}
+	return subvolumes
+}
+
+// btrfsUUID returns "" for UUIDs shown as "-" by btrfs, i.e. unset ones.
+func btrfsUUID(uuid string) string {
+	if uuid == "-" {
+		return ""
+	}
+	return uuid
+}
+
+// parseQgroups returns the level 0 qgroups from the output of
+// `btrfs qgroup show --raw` by subvolume ID.
+func parseQgroups(output string) (map[uint64]QgroupUsage, error) {
+	usage := map[uint64]QgroupUsage{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], "0/") {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimPrefix(fields[0], "0/"), 10, 64)
+		if err != nil {
+			continue
+		}
+		rfer, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		excl, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		usage[id] = QgroupUsage{Referenced: rfer, Exclusive: excl}
+	}
+	return usage, nil
+}
+
+// parseQgroupShow returns referenced and exclusive bytes of the level 0
+// qgroup of the subvolume from the output of `btrfs qgroup show --raw`.
+func parseQgroupShow(output string, subvolumeID uint64) (uint64, uint64, error) {
+	usage, err := parseQgroups(output)
+	if err != nil {
+		return 0, 0, err
+	}
+	qgroup, ok := usage[subvolumeID]
+	if !ok {
+		return 0, 0, errors.New(fmt.Sprintf("no qgroup 0/%d found", subvolumeID))
+	}
+	return qgroup.Referenced, qgroup.Exclusive, nil
+}
+
+func callBtrfs(args ...string) error {
+	logBtrfsCall(args)
+	cmd := exec.Command("btrfs", args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return btrfsError(args, err, string(output))
+	}
+	return nil
+}
+
+func callBtrfsOutput(args ...string) (string, error) {
+	logBtrfsCall(args)
+	cmd := exec.Command("btrfs", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", btrfsError(args, err, stderr.String())
+	}
+	return string(output), nil
+}
+
+// callBtrfsStream runs btrfs with the given stdin and stdout, e.g. for send
+// streams to or from files. Both may be nil.
+func callBtrfsStream(stdin io.Reader, stdout io.Writer, args ...string) error {
+	logBtrfsCall(args)
+	cmd := exec.Command("btrfs", args...)
+	var stderr bytes.Buffer
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return btrfsError(args, err, stderr.String())
+	}
+	return nil
+}
+
+func logBtrfsCall(args []string) {
+	logger.With(Fields{"command": btrfsCommand(args)}).Debug("calling btrfs")
+}
+
+// btrfsError logs the failed btrfs call with its stderr and returns it as error.
+func btrfsError(args []string, err error, stderr string) error {
+	command := btrfsCommand(args)
+	logger.With(Fields{"command": command, "stderr": strings.TrimSpace(stderr)}).WithError(err).Error("btrfs call failed")
+	return errors.New(fmt.Sprintf("Btrfs call %v failed: %s\n%s", command, err.Error(), stderr))
+}
+
+func btrfsCommand(args []string) string {
+	return "btrfs " + strings.Join(args, " ")
+}
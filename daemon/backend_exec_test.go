@@ -0,0 +1,96 @@
+package daemon
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSubvolumeShow(t *testing.T) {
+	output := `/btrfs/vol/snaps/snap1
+	Name: 			snap1
+	UUID: 			0b5fbbc1-5d0e-ae48-9d5b-7e2b0d5b4ef1
+	Parent UUID: 		6d0e0c72-b1e5-e649-9d43-8dfe3bd3d4f0
+	Received UUID: 		-
+	Creation time: 		2017-03-01 12:00:00 +0100
+	Subvolume ID: 		258
+	Generation: 		12
+	Gen at creation: 	12
+	Parent ID: 		5
+	Top level ID: 		5
+	Flags: 			readonly
+`
+
+	subvolume := parseSubvolumeShow(output)
+
+	if subvolume.ID != 258 || subvolume.Generation != 12 || !subvolume.ReadOnly {
+		t.Errorf("Unexpected subvolume %+v", subvolume)
+	}
+	if subvolume.UUID != "0b5fbbc1-5d0e-ae48-9d5b-7e2b0d5b4ef1" || subvolume.ParentUUID != "6d0e0c72-b1e5-e649-9d43-8dfe3bd3d4f0" || subvolume.ReceivedUUID != "" {
+		t.Errorf("Unexpected UUIDs %+v", subvolume)
+	}
+	expected := time.Date(2017, 3, 1, 11, 0, 0, 0, time.UTC)
+	if subvolume.CreationTime == nil || !subvolume.CreationTime.Equal(expected) {
+		t.Errorf("Expected creation time %v, got %v", expected, subvolume.CreationTime)
+	}
+}
+
+func TestParseSubvolumeListDetails(t *testing.T) {
+	output := `ID 257 gen 14 top level 5 parent_uuid - received_uuid - uuid 6d0e0c72-b1e5-e649-9d43-8dfe3bd3d4f0 path vols/vol/current
+ID 258 gen 12 top level 5 parent_uuid 6d0e0c72-b1e5-e649-9d43-8dfe3bd3d4f0 received_uuid - uuid 0b5fbbc1-5d0e-ae48-9d5b-7e2b0d5b4ef1 path <FS_TREE>/vols/vol/snaps/snap 1
+`
+
+	expected := map[string]Subvolume{
+		"vols/vol/current":      {ID: 257, Generation: 14, UUID: "6d0e0c72-b1e5-e649-9d43-8dfe3bd3d4f0"},
+		"vols/vol/snaps/snap 1": {ID: 258, Generation: 12, UUID: "0b5fbbc1-5d0e-ae48-9d5b-7e2b0d5b4ef1", ParentUUID: "6d0e0c72-b1e5-e649-9d43-8dfe3bd3d4f0"},
+	}
+	if subvolumes := parseSubvolumeListDetails(output); !reflect.DeepEqual(expected, subvolumes) {
+		t.Errorf("Expected %+v, got %+v", expected, subvolumes)
+	}
+
+	found := subvolumesIn("vols/vol/snaps", expected)
+	if len(found) != 1 || found["snap 1"].ID != 258 {
+		t.Errorf("Expected only the snapshot, got %+v", found)
+	}
+	if found := subvolumesIn("", map[string]Subvolume{"top": {ID: 256}, "top/nested": {ID: 257}}); len(found) != 1 || found["top"].ID != 256 {
+		t.Errorf("Expected only the top level subvolume, got %+v", found)
+	}
+}
+
+func TestParseQgroupShow(t *testing.T) {
+	output := `qgroupid         rfer         excl 
+--------         ----         ---- 
+0/5             16384        16384 
+0/257         1064960       524288 
+0/258          557056        16384 
+`
+
+	rfer, excl, err := parseQgroupShow(output, 257)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rfer != 1064960 || excl != 524288 {
+		t.Errorf("Expected 1064960/524288, got %d/%d", rfer, excl)
+	}
+
+	if _, _, err := parseQgroupShow(output, 300); err == nil {
+		t.Error("Should fail for unknown subvolume")
+	}
+}
+
+func TestParseQgroups(t *testing.T) {
+	output := `qgroupid         rfer         excl 
+--------         ----         ---- 
+0/5             16384        16384 
+0/257         1064960       524288 
+1/100         1064960       524288 
+`
+
+	usage, err := parseQgroups(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 2 || usage[257].Referenced != 1064960 || usage[257].Exclusive != 524288 {
+		t.Errorf("Unexpected usage %+v", usage)
+	}
+}
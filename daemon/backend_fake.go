@@ -0,0 +1,445 @@
+package daemon
+
+import (
+	"archive/tar"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// fakeSubvolumeHeader is the first entry of the send streams of fakeBackend.
+const fakeSubvolumeHeader = ".subvolume.json"
+
+// fakeBackend emulates subvolumes with plain directories and keeps their
+// metadata in memory, so the driver can be tested without root and btrfs.
+// Subvolumes are identified by inode, so they can be renamed like real ones.
+// Snapshots are full copies, quotas are tracked but not enforced and send
+// streams are tar archives.
+type fakeBackend struct {
+	mutex      *sync.Mutex
+	subvolumes map[fakeInode]*fakeSubvolume
+	nextID     *uint64
+	generation *int64
+}
+
+type fakeInode struct {
+	dev uint64
+	ino uint64
+}
+
+type fakeSubvolume struct {
+	Subvolume
+	limit uint64
+}
+
+type fakeStreamHeader struct {
+	Name string
+	UUID string
+}
+
+func newFakeBackend() fakeBackend {
+	nextID := uint64(256)
+	generation := int64(0)
+	return fakeBackend{
+		mutex:      &sync.Mutex{},
+		subvolumes: map[fakeInode]*fakeSubvolume{},
+		nextID:     &nextID,
+		generation: &generation,
+	}
+}
+
+func (backend fakeBackend) CreateSubvolume(p string) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	if err := backend.checkNew(p); err != nil {
+		return err
+	}
+	if err := os.Mkdir(p, 0755); err != nil {
+		return err
+	}
+	return backend.add(p, Subvolume{})
+}
+
+func (backend fakeBackend) DeleteSubvolume(p string) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	inode, err := backend.find(p)
+	if err != nil {
+		return err
+	}
+	nested, err := backend.list(p)
+	if err != nil {
+		return err
+	}
+	if len(nested) > 0 {
+		return errors.New(fmt.Sprintf("cannot delete %v: contains subvolume %v", p, nested[0]))
+	}
+
+	if err := os.RemoveAll(p); err != nil {
+		return err
+	}
+	delete(backend.subvolumes, inode)
+	return nil
+}
+
+func (backend fakeBackend) SnapshotSubvolume(src string, dst string, readOnly bool) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	inode, err := backend.find(src)
+	if err != nil {
+		return err
+	}
+	source := backend.subvolumes[inode]
+	if err := backend.checkNew(dst); err != nil {
+		return err
+	}
+	if err := copyTree(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+
+	return backend.add(dst, Subvolume{ParentUUID: source.UUID, ReadOnly: readOnly})
+}
+
+func (backend fakeBackend) ListSubvolumes(root string) ([]string, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	return backend.list(root)
+}
+
+func (backend fakeBackend) ShowSubvolume(p string) (Subvolume, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	inode, err := backend.find(p)
+	if err != nil {
+		return Subvolume{}, err
+	}
+	return backend.subvolumes[inode].Subvolume, nil
+}
+
+func (backend fakeBackend) ShowSubvolumes(dir string) (map[string]Subvolume, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	subvolumes := map[string]Subvolume{}
+	for _, fi := range files {
+		if subvolume, ok := backend.subvolumes[inodeFromInfo(fi)]; ok && fi.IsDir() {
+			subvolumes[fi.Name()] = subvolume.Subvolume
+		}
+	}
+	return subvolumes, nil
+}
+
+func (backend fakeBackend) EnableQuota(p string) error {
+	if _, err := os.Stat(p); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (backend fakeBackend) LimitSubvolume(p string, size uint64) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	inode, err := backend.find(p)
+	if err != nil {
+		return err
+	}
+	backend.subvolumes[inode].limit = size
+	return nil
+}
+
+func (backend fakeBackend) QgroupUsage(p string) (map[uint64]QgroupUsage, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	// only the subvolumes below path are known without walking the whole
+	// filesystem, which is enough for the driver
+	paths, err := backend.list(p)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := backend.find(p); err == nil {
+		paths = append(paths, p)
+	}
+
+	usage := map[uint64]QgroupUsage{}
+	for _, subvolumePath := range paths {
+		inode, err := backend.find(subvolumePath)
+		if err != nil {
+			return nil, err
+		}
+		size, err := treeSize(subvolumePath)
+		if err != nil {
+			return nil, err
+		}
+		// copies share nothing, so all data is exclusive
+		usage[backend.subvolumes[inode].ID] = QgroupUsage{Referenced: size, Exclusive: size}
+	}
+	return usage, nil
+}
+
+func (backend fakeBackend) Send(p string, parent string, out io.Writer) error {
+	subvolume, err := backend.ShowSubvolume(p)
+	if err != nil {
+		return err
+	}
+	if !subvolume.ReadOnly {
+		return errors.New(fmt.Sprintf("cannot send %v: subvolume is not read-only", p))
+	}
+
+	// always a full stream, the parent only saves space with real btrfs
+	tw := tar.NewWriter(out)
+	header, _ := json.Marshal(fakeStreamHeader{Name: path.Base(p), UUID: subvolume.UUID})
+	if err := writeTarFile(tw, fakeSubvolumeHeader, header); err != nil {
+		return err
+	}
+
+	err = filepath.Walk(p, func(file string, fi os.FileInfo, err error) error {
+		if err != nil || file == p {
+			return err
+		}
+		rel := strings.TrimPrefix(file, p+"/")
+		h, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		h.Name = rel
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func (backend fakeBackend) Receive(in io.Reader, dir string) error {
+	tr := tar.NewReader(in)
+
+	h, err := tr.Next()
+	if err != nil || h.Name != fakeSubvolumeHeader {
+		return errors.New("invalid send stream")
+	}
+	var header fakeStreamHeader
+	if err := json.NewDecoder(tr).Decode(&header); err != nil {
+		return err
+	}
+
+	target := path.Join(dir, header.Name)
+	backend.mutex.Lock()
+	err = backend.checkNew(target)
+	backend.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(target, 0755); err != nil {
+		return err
+	}
+
+	if err := extractTar(tr, target); err != nil {
+		os.RemoveAll(target)
+		return err
+	}
+
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	return backend.add(target, Subvolume{ReceivedUUID: header.UUID, ReadOnly: true})
+}
+
+func (backend fakeBackend) find(p string) (fakeInode, error) {
+	inode, err := inodeOf(p)
+	if err != nil {
+		return fakeInode{}, err
+	}
+	if _, ok := backend.subvolumes[inode]; !ok {
+		return fakeInode{}, errors.New(fmt.Sprintf("%v is not a subvolume", p))
+	}
+	return inode, nil
+}
+
+// list returns the paths of the subvolumes below root.
+func (backend fakeBackend) list(root string) ([]string, error) {
+	var paths []string
+	err := filepath.Walk(root, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == root || !fi.IsDir() {
+			return nil
+		}
+		if _, ok := backend.subvolumes[inodeFromInfo(fi)]; ok {
+			paths = append(paths, file)
+		}
+		return nil
+	})
+	sort.Strings(paths)
+	return paths, err
+}
+
+func (backend fakeBackend) checkNew(p string) error {
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		return errors.New(fmt.Sprintf("%v already exists", p))
+	}
+	return nil
+}
+
+func (backend fakeBackend) add(p string, subvolume Subvolume) error {
+	inode, err := inodeOf(p)
+	if err != nil {
+		return err
+	}
+
+	*backend.generation++
+	created := time.Now().Truncate(time.Second)
+
+	subvolume.ID = *backend.nextID
+	subvolume.UUID = newFakeUUID()
+	subvolume.Generation = *backend.generation
+	subvolume.CreationTime = &created
+	backend.subvolumes[inode] = &fakeSubvolume{Subvolume: subvolume}
+
+	*backend.nextID++
+	return nil
+}
+
+func inodeOf(p string) (fakeInode, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return fakeInode{}, err
+	}
+	return inodeFromInfo(fi), nil
+}
+
+func inodeFromInfo(fi os.FileInfo) fakeInode {
+	stat := fi.Sys().(*syscall.Stat_t)
+	return fakeInode{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}
+}
+
+func newFakeUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func copyTree(src string, dst string) error {
+	return filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		target := path.Join(dst, strings.TrimPrefix(file, src))
+
+		switch {
+		case fi.IsDir():
+			return os.Mkdir(target, fi.Mode().Perm())
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case fi.Mode().IsRegular():
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(target, data, fi.Mode().Perm()); err != nil {
+				return err
+			}
+			// like snapshots, keep the modification time of files
+			return os.Chtimes(target, fi.ModTime(), fi.ModTime())
+		}
+		return nil
+	})
+}
+
+func treeSize(root string) (uint64, error) {
+	var size uint64
+	err := filepath.Walk(root, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += uint64(fi.Size())
+		}
+		return nil
+	})
+	return size, err
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data))}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func extractTar(tr *tar.Reader, dir string) error {
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target := path.Join(dir, h.Name)
+		if !strings.HasPrefix(target, dir+"/") {
+			return errors.New(fmt.Sprintf("invalid path %q in send stream", h.Name))
+		}
+
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(target, os.FileMode(h.Mode).Perm()); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(h.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(h.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
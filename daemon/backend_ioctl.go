@@ -0,0 +1,489 @@
+package daemon
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ioctl numbers and structs from linux/btrfs.h
+const (
+	btrfsIoctlMagic = 0x94
+	iocWrite        = 1
+	iocReadWrite    = 3
+
+	iocSubvolCreate = iocWrite<<30 | unsafe.Sizeof(btrfsVolArgs{})<<16 | btrfsIoctlMagic<<8 | 14
+	iocSnapDestroy  = iocWrite<<30 | unsafe.Sizeof(btrfsVolArgs{})<<16 | btrfsIoctlMagic<<8 | 15
+	iocTreeSearch   = iocReadWrite<<30 | unsafe.Sizeof(btrfsSearchArgs{})<<16 | btrfsIoctlMagic<<8 | 17
+	iocInoLookup    = iocReadWrite<<30 | unsafe.Sizeof(btrfsInoLookupArgs{})<<16 | btrfsIoctlMagic<<8 | 18
+	iocSnapCreateV2 = iocWrite<<30 | unsafe.Sizeof(btrfsVolArgsV2{})<<16 | btrfsIoctlMagic<<8 | 23
+	// iocClone is also known as FICLONE
+	iocClone = iocWrite<<30 | unsafe.Sizeof(int32(0))<<16 | btrfsIoctlMagic<<8 | 9
+
+	btrfsSubvolReadOnly = 1 << 1
+	btrfsRootReadOnly   = 1 << 0
+
+	btrfsRootTreeID      = 1
+	btrfsFSTreeID        = 5
+	btrfsFirstFreeID     = 256
+	btrfsLastFreeID      = 1<<64 - 256
+	btrfsRootItemKey     = 132
+	btrfsRootBackrefKey  = 144
+	btrfsSearchHeaderLen = 32
+)
+
+type btrfsVolArgs struct {
+	fd   int64
+	name [4088]byte
+}
+
+type btrfsVolArgsV2 struct {
+	fd      int64
+	transid uint64
+	flags   uint64
+	unused  [4]uint64
+	name    [4040]byte
+}
+
+type btrfsSearchKey struct {
+	treeID      uint64
+	minObjectID uint64
+	maxObjectID uint64
+	minOffset   uint64
+	maxOffset   uint64
+	minTransid  uint64
+	maxTransid  uint64
+	minType     uint32
+	maxType     uint32
+	nrItems     uint32
+	unused      uint32
+	unused1     [4]uint64
+}
+
+type btrfsSearchArgs struct {
+	key btrfsSearchKey
+	buf [4096 - unsafe.Sizeof(btrfsSearchKey{})]byte
+}
+
+type btrfsInoLookupArgs struct {
+	treeID   uint64
+	objectID uint64
+	name     [4080]byte
+}
+
+// btrfsSearchItem is an item returned by the tree search ioctl.
+type btrfsSearchItem struct {
+	objectID uint64
+	offset   uint64
+	typ      uint32
+	data     []byte
+}
+
+// btrfsRootRef is a ROOT_BACKREF item, i.e. the location of a subvolume in
+// its parent subvolume.
+type btrfsRootRef struct {
+	parentID uint64
+	dirID    uint64
+	name     string
+}
+
+// IoctlError is returned by the ioctl backend for a failed ioctl.
+type IoctlError struct {
+	Op   string
+	Path string
+	Err  syscall.Errno
+}
+
+func (e *IoctlError) Error() string {
+	return fmt.Sprintf("btrfs %v %v: %v", e.Op, e.Path, e.Err.Error())
+}
+
+// ioctlBackend calls the btrfs ioctls directly instead of the btrfs tool.
+// Quotas and send streams are left to the btrfs tool.
+type ioctlBackend struct {
+	execBackend
+}
+
+func (ioctlBackend) CreateSubvolume(p string) error {
+	var args btrfsVolArgs
+	if err := setIoctlName(args.name[:], path.Base(p)); err != nil {
+		return err
+	}
+	return withDir(path.Dir(p), func(fd int) error {
+		return btrfsIoctl("subvolume-create", p, fd, iocSubvolCreate, unsafe.Pointer(&args))
+	})
+}
+
+func (ioctlBackend) DeleteSubvolume(p string) error {
+	var args btrfsVolArgs
+	if err := setIoctlName(args.name[:], path.Base(p)); err != nil {
+		return err
+	}
+	return withDir(path.Dir(p), func(fd int) error {
+		return btrfsIoctl("subvolume-delete", p, fd, iocSnapDestroy, unsafe.Pointer(&args))
+	})
+}
+
+func (ioctlBackend) SnapshotSubvolume(src string, dst string, readOnly bool) error {
+	var args btrfsVolArgsV2
+	if err := setIoctlName(args.name[:], path.Base(dst)); err != nil {
+		return err
+	}
+	if readOnly {
+		args.flags = btrfsSubvolReadOnly
+	}
+	return withDir(src, func(srcFd int) error {
+		args.fd = int64(srcFd)
+		return withDir(path.Dir(dst), func(fd int) error {
+			return btrfsIoctl("subvolume-snapshot", dst, fd, iocSnapCreateV2, unsafe.Pointer(&args))
+		})
+	})
+}
+
+func (ioctlBackend) ListSubvolumes(root string) ([]string, error) {
+	var relPaths []string
+	err := withDir(root, func(fd int) error {
+		refs, err := rootRefs(root, fd)
+		if err != nil {
+			return err
+		}
+		relPaths, err = subvolumePaths(refs, func(treeID uint64, dirID uint64) (string, error) {
+			return inoLookup(root, fd, treeID, dirID)
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subvolumesBelow(root, relPaths)
+}
+
+// ShowSubvolumes searches the root tree once for the paths and once for the
+// root items of all subvolumes.
+func (ioctlBackend) ShowSubvolumes(dir string) (map[string]Subvolume, error) {
+	relDir, err := topLevelPath(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	subvolumes := map[string]Subvolume{}
+	err = withDir(dir, func(fd int) error {
+		refs, err := rootRefs(dir, fd)
+		if err != nil {
+			return err
+		}
+		relPaths, err := resolveSubvolumePaths(refs, func(treeID uint64, dirID uint64) (string, error) {
+			return inoLookup(dir, fd, treeID, dirID)
+		})
+		if err != nil {
+			return err
+		}
+
+		items, err := treeSearch(dir, fd, btrfsRootTreeID, btrfsFirstFreeID, btrfsLastFreeID, btrfsRootItemKey)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			rel, ok := relPaths[item.objectID]
+			if !ok {
+				continue
+			}
+			subvolume, err := parseRootItem(item.data)
+			if err != nil {
+				return err
+			}
+			subvolume.ID = item.objectID
+			subvolumes[rel] = subvolume
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subvolumesIn(relDir, subvolumes), nil
+}
+
+// rootRefs returns the references of all subvolumes to their parents.
+func rootRefs(p string, fd int) (map[uint64]btrfsRootRef, error) {
+	items, err := treeSearch(p, fd, btrfsRootTreeID, btrfsFirstFreeID, btrfsLastFreeID, btrfsRootBackrefKey)
+	if err != nil {
+		return nil, err
+	}
+	refs := map[uint64]btrfsRootRef{}
+	for _, item := range items {
+		ref, err := parseRootRef(item)
+		if err != nil {
+			return nil, err
+		}
+		refs[item.objectID] = ref
+	}
+	return refs, nil
+}
+
+func (ioctlBackend) ShowSubvolume(p string) (Subvolume, error) {
+	var subvolume Subvolume
+	err := withDir(p, func(fd int) error {
+		var stat unix.Stat_t
+		if err := unix.Fstat(fd, &stat); err != nil {
+			return &IoctlError{Op: "subvolume-show", Path: p, Err: errnoOf(err)}
+		}
+		if stat.Ino != btrfsFirstFreeID {
+			return &IoctlError{Op: "subvolume-show", Path: p, Err: unix.EINVAL}
+		}
+
+		// tree 0 looks up the tree of the open subvolume
+		var args btrfsInoLookupArgs
+		args.objectID = btrfsFirstFreeID
+		if err := btrfsIoctl("ino-lookup", p, fd, iocInoLookup, unsafe.Pointer(&args)); err != nil {
+			return err
+		}
+
+		items, err := treeSearch(p, fd, btrfsRootTreeID, args.treeID, args.treeID, btrfsRootItemKey)
+		if err != nil {
+			return err
+		}
+		if len(items) == 0 {
+			return &IoctlError{Op: "subvolume-show", Path: p, Err: unix.ENOENT}
+		}
+		subvolume, err = parseRootItem(items[0].data)
+		subvolume.ID = args.treeID
+		return err
+	})
+	return subvolume, err
+}
+
+// treeSearch returns all items of the given type with object IDs between
+// min and max from the tree.
+func treeSearch(p string, fd int, treeID uint64, min uint64, max uint64, typ uint32) ([]btrfsSearchItem, error) {
+	var args btrfsSearchArgs
+	args.key = btrfsSearchKey{
+		treeID:      treeID,
+		minObjectID: min,
+		maxObjectID: max,
+		maxOffset:   1<<64 - 1,
+		maxTransid:  1<<64 - 1,
+		minType:     typ,
+		maxType:     typ,
+	}
+
+	var items []btrfsSearchItem
+	for {
+		args.key.nrItems = 4096
+		if err := btrfsIoctl("tree-search", p, fd, iocTreeSearch, unsafe.Pointer(&args)); err != nil {
+			return nil, err
+		}
+		if args.key.nrItems == 0 {
+			return items, nil
+		}
+
+		batch, err := parseSearchItems(args.buf[:], args.key.nrItems)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range batch {
+			if item.typ == typ {
+				items = append(items, item)
+			}
+		}
+
+		// continue after the last key
+		last := batch[len(batch)-1]
+		args.key.minObjectID = last.objectID
+		args.key.minOffset = last.offset + 1
+		if last.offset == 1<<64-1 {
+			if last.objectID == max {
+				return items, nil
+			}
+			args.key.minObjectID++
+			args.key.minOffset = 0
+		}
+	}
+}
+
+// parseSearchItems splits the buffer of the tree search ioctl into items.
+// The headers are in host byte order, which is little endian like btrfs
+// itself on all supported platforms.
+func parseSearchItems(buf []byte, count uint32) ([]btrfsSearchItem, error) {
+	var items []btrfsSearchItem
+	for i := uint32(0); i < count; i++ {
+		if len(buf) < btrfsSearchHeaderLen {
+			return nil, errors.New("truncated tree search result")
+		}
+		length := binary.LittleEndian.Uint32(buf[28:32])
+		if uint32(len(buf)-btrfsSearchHeaderLen) < length {
+			return nil, errors.New("truncated tree search result")
+		}
+		items = append(items, btrfsSearchItem{
+			objectID: binary.LittleEndian.Uint64(buf[8:16]),
+			offset:   binary.LittleEndian.Uint64(buf[16:24]),
+			typ:      binary.LittleEndian.Uint32(buf[24:28]),
+			// the buffer is reused for the next search
+			data: append([]byte(nil), buf[btrfsSearchHeaderLen:btrfsSearchHeaderLen+length]...),
+		})
+		buf = buf[btrfsSearchHeaderLen+length:]
+	}
+	return items, nil
+}
+
+// parseRootRef parses a ROOT_BACKREF item, whose offset is the parent tree.
+func parseRootRef(item btrfsSearchItem) (btrfsRootRef, error) {
+	if len(item.data) < 18 {
+		return btrfsRootRef{}, errors.New("truncated root ref")
+	}
+	nameLen := int(binary.LittleEndian.Uint16(item.data[16:18]))
+	if len(item.data) < 18+nameLen {
+		return btrfsRootRef{}, errors.New("truncated root ref")
+	}
+	return btrfsRootRef{
+		parentID: item.offset,
+		dirID:    binary.LittleEndian.Uint64(item.data[0:8]),
+		name:     string(item.data[18 : 18+nameLen]),
+	}, nil
+}
+
+// parseRootItem parses the parts of a ROOT_ITEM shown by
+// `btrfs subvolume show`. Items written by old kernels lack the UUIDs and
+// times.
+func parseRootItem(data []byte) (Subvolume, error) {
+	if len(data) < 239 {
+		return Subvolume{}, errors.New("truncated root item")
+	}
+	subvolume := Subvolume{
+		Generation: int64(binary.LittleEndian.Uint64(data[160:168])),
+		ReadOnly:   binary.LittleEndian.Uint64(data[208:216])&btrfsRootReadOnly != 0,
+	}
+	if len(data) < 351 {
+		return subvolume, nil
+	}
+	subvolume.UUID = formatBtrfsUUID(data[247:263])
+	subvolume.ParentUUID = formatBtrfsUUID(data[263:279])
+	subvolume.ReceivedUUID = formatBtrfsUUID(data[279:295])
+	if sec := binary.LittleEndian.Uint64(data[339:347]); sec != 0 {
+		created := time.Unix(int64(sec), int64(binary.LittleEndian.Uint32(data[347:351])))
+		subvolume.CreationTime = &created
+	}
+	return subvolume, nil
+}
+
+// formatBtrfsUUID formats a UUID like btrfs does, returning "" for unset ones.
+func formatBtrfsUUID(b []byte) string {
+	for _, c := range b {
+		if c != 0 {
+			return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+		}
+	}
+	return ""
+}
+
+// subvolumePaths returns the paths of the subvolumes relative to the top
+// level subvolume, like `btrfs subvolume list`. lookup returns the path of
+// a directory relative to the root of its subvolume.
+func subvolumePaths(refs map[uint64]btrfsRootRef, lookup func(treeID uint64, dirID uint64) (string, error)) ([]string, error) {
+	resolved, err := resolveSubvolumePaths(refs, lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, p := range resolved {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// resolveSubvolumePaths returns the paths of subvolumePaths by subvolume ID.
+func resolveSubvolumePaths(refs map[uint64]btrfsRootRef, lookup func(treeID uint64, dirID uint64) (string, error)) (map[uint64]string, error) {
+	resolved := map[uint64]string{btrfsFSTreeID: ""}
+
+	var resolve func(id uint64, depth int) (string, error)
+	resolve = func(id uint64, depth int) (string, error) {
+		if p, ok := resolved[id]; ok {
+			return p, nil
+		}
+		ref, ok := refs[id]
+		if !ok || depth > len(refs) {
+			return "", errors.New(fmt.Sprintf("cannot resolve path of subvolume %d", id))
+		}
+		parent, err := resolve(ref.parentID, depth+1)
+		if err != nil {
+			return "", err
+		}
+		dir, err := lookup(ref.parentID, ref.dirID)
+		if err != nil {
+			return "", err
+		}
+		p := strings.TrimPrefix(path.Join(parent, dir, ref.name), "/")
+		resolved[id] = p
+		return p, nil
+	}
+
+	paths := map[uint64]string{}
+	for id := range refs {
+		p, err := resolve(id, 0)
+		if err != nil {
+			return nil, err
+		}
+		paths[id] = p
+	}
+	return paths, nil
+}
+
+func inoLookup(p string, fd int, treeID uint64, dirID uint64) (string, error) {
+	args := btrfsInoLookupArgs{treeID: treeID, objectID: dirID}
+	if err := btrfsIoctl("ino-lookup", p, fd, iocInoLookup, unsafe.Pointer(&args)); err != nil {
+		return "", err
+	}
+	return cString(args.name[:]), nil
+}
+
+func btrfsIoctl(op string, p string, fd int, request uintptr, args unsafe.Pointer) error {
+	logger.With(Fields{"ioctl": op, "path": p}).Debug("calling btrfs ioctl")
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), request, uintptr(args))
+	if errno != 0 {
+		err := &IoctlError{Op: op, Path: p, Err: errno}
+		logger.With(Fields{"ioctl": op, "path": p}).WithError(err).Error("btrfs ioctl failed")
+		return err
+	}
+	return nil
+}
+
+// withDir calls fn with a file descriptor of the directory.
+func withDir(dir string, fn func(fd int) error) error {
+	fd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &IoctlError{Op: "open", Path: dir, Err: errnoOf(err)}
+	}
+	defer unix.Close(fd)
+	return fn(fd)
+}
+
+func errnoOf(err error) syscall.Errno {
+	if errno, ok := err.(syscall.Errno); ok {
+		return errno
+	}
+	return unix.EIO
+}
+
+func setIoctlName(dst []byte, name string) error {
+	if len(name) >= len(dst) || strings.Contains(name, "\x00") {
+		return errors.New(fmt.Sprintf("invalid subvolume name %q", name))
+	}
+	copy(dst, name)
+	return nil
+}
+
+func cString(b []byte) string {
+	if i := strings.IndexByte(string(b), 0); i >= 0 {
+		return string(b[:i])
+	}
+	return string(b)
+}
@@ -0,0 +1,130 @@
+package daemon
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestIoctlArgSizes(t *testing.T) {
+	sizes := map[string]uintptr{
+		"vol_args":        unsafe.Sizeof(btrfsVolArgs{}),
+		"vol_args_v2":     unsafe.Sizeof(btrfsVolArgsV2{}),
+		"search_key":      unsafe.Sizeof(btrfsSearchKey{}),
+		"search_args":     unsafe.Sizeof(btrfsSearchArgs{}),
+		"ino_lookup_args": unsafe.Sizeof(btrfsInoLookupArgs{}),
+	}
+	expected := map[string]uintptr{
+		"vol_args":        4096,
+		"vol_args_v2":     4096,
+		"search_key":      104,
+		"search_args":     4096,
+		"ino_lookup_args": 4096,
+	}
+	if !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("Expected sizes %v, got %v", expected, sizes)
+	}
+	if iocSubvolCreate != 0x5000940e || iocSnapCreateV2 != 0x50009417 || iocTreeSearch != 0xd0009411 {
+		t.Errorf("Unexpected ioctl numbers %x %x %x", iocSubvolCreate, iocSnapCreateV2, iocTreeSearch)
+	}
+}
+
+func TestParseSearchItems(t *testing.T) {
+	buf := append(searchItem(257, 5, btrfsRootBackrefKey, rootRef(256, "vol")), searchItem(258, 257, btrfsRootBackrefKey, rootRef(260, "snap"))...)
+	buf = append(buf, make([]byte, 64)...)
+
+	items, err := parseSearchItems(buf, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[1].objectID != 258 || items[1].offset != 257 || items[1].typ != btrfsRootBackrefKey {
+		t.Fatalf("Unexpected items %+v", items)
+	}
+
+	ref, err := parseRootRef(items[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref != (btrfsRootRef{parentID: 257, dirID: 260, name: "snap"}) {
+		t.Errorf("Unexpected root ref %+v", ref)
+	}
+
+	if _, err := parseSearchItems(buf[:40], 1); err == nil {
+		t.Error("Expected error for truncated item")
+	}
+}
+
+func TestParseRootItem(t *testing.T) {
+	data := make([]byte, 439)
+	binary.LittleEndian.PutUint64(data[160:], 12)
+	binary.LittleEndian.PutUint64(data[208:], btrfsRootReadOnly)
+	for i := 0; i < 16; i++ {
+		data[247+i] = byte(i + 1)
+	}
+	binary.LittleEndian.PutUint64(data[339:], 1488366000)
+
+	subvolume, err := parseRootItem(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if subvolume.Generation != 12 || !subvolume.ReadOnly {
+		t.Errorf("Unexpected subvolume %+v", subvolume)
+	}
+	if subvolume.UUID != "01020304-0506-0708-090a-0b0c0d0e0f10" || subvolume.ParentUUID != "" || subvolume.ReceivedUUID != "" {
+		t.Errorf("Unexpected UUIDs %+v", subvolume)
+	}
+	expected := time.Date(2017, 3, 1, 11, 0, 0, 0, time.UTC)
+	if subvolume.CreationTime == nil || !subvolume.CreationTime.Equal(expected) {
+		t.Errorf("Expected creation time %v, got %v", expected, subvolume.CreationTime)
+	}
+
+	if _, err := parseRootItem(data[:100]); err == nil {
+		t.Error("Expected error for truncated root item")
+	}
+}
+
+func TestSubvolumePaths(t *testing.T) {
+	refs := map[uint64]btrfsRootRef{
+		257: {parentID: 5, dirID: 256, name: "vol"},
+		258: {parentID: 257, dirID: 300, name: "snap1"},
+		259: {parentID: 5, dirID: 301, name: "other"},
+	}
+	dirs := map[uint64]string{256: "", 300: "snaps/", 301: "data/"}
+	lookup := func(treeID uint64, dirID uint64) (string, error) {
+		return dirs[dirID], nil
+	}
+
+	paths, err := subvolumePaths(refs, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"data/other", "vol", "vol/snaps/snap1"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected %v, got %v", expected, paths)
+	}
+
+	refs[260] = btrfsRootRef{parentID: 999, dirID: 256, name: "orphan"}
+	if _, err := subvolumePaths(refs, lookup); err == nil {
+		t.Error("Expected error for unknown parent")
+	}
+}
+
+func searchItem(objectID uint64, offset uint64, typ uint32, data []byte) []byte {
+	header := make([]byte, btrfsSearchHeaderLen)
+	binary.LittleEndian.PutUint64(header[8:], objectID)
+	binary.LittleEndian.PutUint64(header[16:], offset)
+	binary.LittleEndian.PutUint32(header[24:], typ)
+	binary.LittleEndian.PutUint32(header[28:], uint32(len(data)))
+	return append(header, data...)
+}
+
+func rootRef(dirID uint64, name string) []byte {
+	data := make([]byte, 18)
+	binary.LittleEndian.PutUint64(data[0:], dirID)
+	binary.LittleEndian.PutUint16(data[16:], uint16(len(name)))
+	return append(data, name...)
+}
@@ -0,0 +1,176 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/BurntSushi/toml"
+)
+
+const DefaultConfigFile = "/etc/local-btrfs.toml"
+
+// Config contains the settings of the daemon. The CLI uses it to find the
+// RPC socket of the daemon.
+type Config struct {
+	// Socket is the unix socket of the RPC API used by the CLI.
+	Socket string `toml:"socket"`
+	// PluginName is the name of the volume driver in docker, which also
+	// determines the socket in /run/docker/plugins.
+	PluginName string `toml:"plugin_name"`
+	StateDir   string `toml:"state_dir"`
+	StateFile  string `toml:"state_file"`
+	// DefaultRoot is the directory in which volumes without a mountpoint are
+	// created.
+	DefaultRoot string `toml:"default_root"`
+	// Roots are additional directories for volumes, selected by name with
+	// the root option.
+	Roots     map[string]string `toml:"roots"`
+	LogLevel  string            `toml:"log_level"`
+	LogFormat string            `toml:"log_format"`
+	// Backend performs the btrfs operations, "exec" calls the btrfs tool,
+	// "ioctl" calls the kernel directly where possible and "fake" emulates
+	// subvolumes with directories for tests.
+	Backend string `toml:"backend"`
+	// ListSnapshots includes the snapshots of volumes as read-only volumes
+	// named <volume>@<snapshot> in the volume list of docker.
+	ListSnapshots bool `toml:"list_snapshots"`
+	// MetricsListen is the address of the HTTP listener serving Prometheus
+	// metrics at /metrics, e.g. ":9410". It is disabled if empty.
+	MetricsListen string `toml:"metrics_listen"`
+	// Snapshots are used for volumes created without snapshot options.
+	Snapshots SnapshotDefaults `toml:"snapshots"`
+	// Hooks define the hook commands and are used for volumes created
+	// without hook options.
+	Hooks HookDefaults `toml:"hooks"`
+}
+
+// SnapshotDefaults mirror the snapshot options of volumes.
+type SnapshotDefaults struct {
+	Interval    string `toml:"snapshot_interval"`
+	KeepHourly  int    `toml:"keep_hourly"`
+	KeepDaily   int    `toml:"keep_daily"`
+	KeepWeekly  int    `toml:"keep_weekly"`
+	KeepMonthly int    `toml:"keep_monthly"`
+}
+
+// HookDefaults mirror the hook options of volumes.
+type HookDefaults struct {
+	PreSnapshot  string `toml:"pre_snapshot_hook"`
+	PostSnapshot string `toml:"post_snapshot_hook"`
+	Timeout      string `toml:"hook_timeout"`
+	// Commands are the shell commands the hooks refer to by name.
+	Commands map[string]string `toml:"commands"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Socket:     "/var/run/local-btrfs.sock",
+		PluginName: "local-btrfs",
+		StateDir:   "/var/lib/docker/plugin-data/",
+		StateFile:  "local-btrfs.json",
+		LogLevel:   "info",
+		LogFormat:  "text",
+		Backend:    backendExec,
+	}
+}
+
+// LoadConfig reads the config file at p on top of the default config. A
+// missing file is only an error if required is set.
+func LoadConfig(p string, required bool) (Config, error) {
+	config := DefaultConfig()
+
+	if _, err := toml.DecodeFile(p, &config); err != nil {
+		if os.IsNotExist(err) && !required {
+			return config, nil
+		}
+		return Config{}, errors.New(fmt.Sprintf("could not load config file %v: %v", p, err))
+	}
+
+	return config, nil
+}
+
+func (config Config) Validate() error {
+	for name, value := range map[string]string{
+		"socket":      config.Socket,
+		"plugin_name": config.PluginName,
+		"state_dir":   config.StateDir,
+		"state_file":  config.StateFile,
+	} {
+		if value == "" {
+			return errors.New(fmt.Sprintf("config option %s must not be empty", name))
+		}
+	}
+
+	if config.DefaultRoot != "" && !path.IsAbs(config.DefaultRoot) {
+		return errors.New(fmt.Sprintf("config option default_root must be an absolute path, got %q", config.DefaultRoot))
+	}
+	for name, root := range config.Roots {
+		if name == "" || !path.IsAbs(root) {
+			return errors.New(fmt.Sprintf("root %q must be an absolute path, got %q", name, root))
+		}
+	}
+
+	if indexOf(logLevels, config.LogLevel) < 0 {
+		return errors.New(fmt.Sprintf("invalid log_level %q, must be one of %v", config.LogLevel, logLevels))
+	}
+	if indexOf(logFormats, config.LogFormat) < 0 {
+		return errors.New(fmt.Sprintf("invalid log_format %q, must be one of %v", config.LogFormat, logFormats))
+	}
+
+	if indexOf(backendNames, config.Backend) < 0 {
+		return errors.New(fmt.Sprintf("invalid backend %q, must be one of %v", config.Backend, backendNames))
+	}
+
+	if _, err := config.Snapshots.schedule(); err != nil {
+		return err
+	}
+	hooks, err := config.Hooks.hooks()
+	if err != nil {
+		return err
+	}
+	return config.Hooks.checkHooks(hooks)
+}
+
+func (config Config) statePath() string {
+	return path.Join(config.StateDir, config.StateFile)
+}
+
+// schedule returns the default schedule, or nil if none is configured.
+func (defaults SnapshotDefaults) schedule() (*SnapshotSchedule, error) {
+	options := map[string]string{}
+	if defaults.Interval != "" {
+		options["snapshot_interval"] = defaults.Interval
+	}
+	keeps := map[string]int{
+		"keep_hourly":  defaults.KeepHourly,
+		"keep_daily":   defaults.KeepDaily,
+		"keep_weekly":  defaults.KeepWeekly,
+		"keep_monthly": defaults.KeepMonthly,
+	}
+	for option, keep := range keeps {
+		if keep != 0 {
+			options[option] = strconv.Itoa(keep)
+		}
+	}
+
+	return parseSchedule(options)
+}
+
+// hooks returns the default hooks, or nil if none are configured.
+func (defaults HookDefaults) hooks() (*SnapshotHooks, error) {
+	options := map[string]string{}
+	for option, value := range map[string]string{
+		"pre_snapshot_hook":  defaults.PreSnapshot,
+		"post_snapshot_hook": defaults.PostSnapshot,
+		"hook_timeout":       defaults.Timeout,
+	} {
+		if value != "" {
+			options[option] = value
+		}
+	}
+
+	return parseHooks(options)
+}
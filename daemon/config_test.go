@@ -0,0 +1,100 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig_overridesDefaults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local-btrfs-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := path.Join(dir, "local-btrfs.toml")
+	content := `
+socket = "/tmp/test.sock"
+state_dir = "/tmp/state"
+log_level = "debug"
+
+[roots]
+fast = "/ssd/volumes"
+
+[snapshots]
+snapshot_interval = "1h"
+keep_daily = 7
+
+[hooks]
+pre_snapshot_hook = "sync"
+
+[hooks.commands]
+sync = "sync -f $LOCAL_BTRFS_PATH"
+`
+	if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(p, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Socket != "/tmp/test.sock" || config.statePath() != "/tmp/state/local-btrfs.json" || config.LogLevel != "debug" {
+		t.Errorf("Unexpected config %+v", config)
+	}
+	if config.Roots["fast"] != "/ssd/volumes" {
+		t.Errorf("Expected root fast, got %v", config.Roots)
+	}
+	if config.PluginName != "local-btrfs" {
+		t.Errorf("Expected default plugin name, got %q", config.PluginName)
+	}
+
+	schedule, err := config.Snapshots.schedule()
+	if err != nil || schedule == nil || schedule.Interval != time.Hour || schedule.KeepDaily != 7 || schedule.KeepHourly != 0 {
+		t.Errorf("Unexpected default schedule %+v (%v)", schedule, err)
+	}
+	if config.Hooks.PreSnapshot != "sync" || config.Hooks.Commands["sync"] != "sync -f $LOCAL_BTRFS_PATH" {
+		t.Errorf("Unexpected hooks %+v", config.Hooks)
+	}
+}
+
+func TestLoadConfig_missingFile(t *testing.T) {
+	config, err := LoadConfig("/does/not/exist.toml", false)
+	if err != nil || config.Socket != DefaultConfig().Socket || config.StateDir != DefaultConfig().StateDir {
+		t.Error("Missing optional config file should result in default config, got", err)
+	}
+
+	if _, err := LoadConfig("/does/not/exist.toml", true); err == nil {
+		t.Error("Missing required config file should fail")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Error("Default config should be valid, got", err)
+	}
+
+	invalid := map[string]func(*Config){
+		"log level":        func(c *Config) { c.LogLevel = "verbose" },
+		"empty socket":     func(c *Config) { c.Socket = "" },
+		"relative root":    func(c *Config) { c.DefaultRoot = "volumes" },
+		"relative pool":    func(c *Config) { c.Roots = map[string]string{"fast": "ssd"} },
+		"invalid interval": func(c *Config) { c.Snapshots.Interval = "often" },
+		"invalid timeout":  func(c *Config) { c.Hooks.Timeout = "soon" },
+		"unknown hook":     func(c *Config) { c.Hooks.PreSnapshot = "sync" },
+	}
+	for name, modify := range invalid {
+		config := DefaultConfig()
+		modify(&config)
+		if err := config.Validate(); err == nil {
+			t.Errorf("Config with %s should be invalid", name)
+		}
+	}
+}
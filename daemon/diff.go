@@ -0,0 +1,212 @@
+package daemon
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	DiffAdded    = "added"
+	DiffModified = "modified"
+	DiffDeleted  = "deleted"
+
+	// diffCurrent compares with the current state instead of a snapshot.
+	diffCurrent = "current"
+)
+
+// DiffEntry is a changed path relative to the volume. Size is the size after
+// the change, or before it for deleted paths.
+type DiffEntry struct {
+	Path    string
+	Change  string
+	Dir     bool `json:",omitempty"`
+	Size    int64
+	OldSize int64 `json:",omitempty"`
+}
+
+type DiffReport struct {
+	Volume  string
+	From    string
+	To      string
+	Entries []DiffEntry
+}
+
+// diffSnapshots compares the snapshot from with the snapshot to, or with the
+// current state if to is "" or "current".
+func (driver LocalBtrfsDriver) diffSnapshots(volumeName string, from string, to string) (report DiffReport, err error) {
+	defer logOperation("diff-snapshots", Fields{"volume": volumeName, "from": from, "to": to}, time.Now(), &err)
+
+	volumePath, err := driver.getVolumePath(volumeName)
+	if err != nil {
+		return DiffReport{}, err
+	}
+
+	if to == "" {
+		to = diffCurrent
+	}
+	fromPath, err := driver.diffSourcePath(volumeName, volumePath, from)
+	if err != nil {
+		return DiffReport{}, err
+	}
+	toPath, err := driver.diffSourcePath(volumeName, volumePath, to)
+	if err != nil {
+		return DiffReport{}, err
+	}
+
+	entries, err := diffTrees(fromPath, toPath)
+	if err != nil {
+		return DiffReport{}, err
+	}
+	return DiffReport{Volume: volumeName, From: from, To: to, Entries: entries}, nil
+}
+
+func (driver LocalBtrfsDriver) diffSourcePath(volumeName string, volumePath string, name string) (string, error) {
+	if name == diffCurrent {
+		return volumePath + "/current", nil
+	}
+	return driver.existingSnapshotPath(volumeName, name)
+}
+
+// diffTrees compares two trees by their metadata. Unlike the generation
+// numbers used by `btrfs subvolume find-new`, this also finds deleted files.
+// Both trees are walked completely, so it costs a stat of every path, i.e.
+// O(files), however little changed. Snapshots keep the inode numbers and
+// metadata of unchanged files, so contents are only read for files with a new
+// inode or changed times, but the same size. Changes of directories
+// themselves aren't reported, only the changes of their entries.
+func diffTrees(from string, to string) ([]DiffEntry, error) {
+	before, err := walkTree(from)
+	if err != nil {
+		return nil, err
+	}
+	after, err := walkTree(to)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []DiffEntry
+	for p, old := range before {
+		fi, ok := after[p]
+		switch {
+		case !ok:
+			entries = append(entries, DiffEntry{Path: p, Change: DiffDeleted, Dir: old.IsDir(), Size: entrySize(old)})
+		case old.IsDir() && fi.IsDir():
+			continue
+		case changed(old, fi, filepath.Join(from, p), filepath.Join(to, p)):
+			entries = append(entries, DiffEntry{Path: p, Change: DiffModified, Dir: fi.IsDir(), Size: entrySize(fi), OldSize: entrySize(old)})
+		}
+	}
+	for p, fi := range after {
+		if _, ok := before[p]; !ok {
+			entries = append(entries, DiffEntry{Path: p, Change: DiffAdded, Dir: fi.IsDir(), Size: entrySize(fi)})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, nil
+}
+
+// walkTree returns the file infos of all paths below root by relative path.
+func walkTree(root string) (map[string]os.FileInfo, error) {
+	infos := map[string]os.FileInfo{}
+	err := filepath.Walk(root, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if file != root {
+			infos[strings.TrimPrefix(file, root+"/")] = fi
+		}
+		return nil
+	})
+	return infos, err
+}
+
+func changed(old os.FileInfo, fi os.FileInfo, oldPath string, p string) bool {
+	if old.Mode() != fi.Mode() {
+		return true
+	}
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		oldTarget, _ := os.Readlink(oldPath)
+		target, _ := os.Readlink(p)
+		return oldTarget != target
+	case !fi.Mode().IsRegular():
+		return false
+	case old.Size() != fi.Size():
+		return true
+	case sameInode(old, fi) && sameTimes(old, fi):
+		return false
+	}
+	// only touched or replaced files of the same size get here
+	same, err := sameContent(oldPath, p)
+	return err != nil || !same
+}
+
+// sameInode returns true if both infos are of the same inode, i.e. the file
+// wasn't replaced since the snapshot.
+func sameInode(old os.FileInfo, fi os.FileInfo) bool {
+	oldStat, ok := old.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && oldStat.Ino == stat.Ino
+}
+
+// sameTimes compares modification and change times. The change time catches
+// content changes with a restored modification time.
+func sameTimes(old os.FileInfo, fi os.FileInfo) bool {
+	if !old.ModTime().Equal(fi.ModTime()) {
+		return false
+	}
+	oldStat, ok := old.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && oldStat.Ctim == stat.Ctim
+}
+
+func sameContent(a string, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufA, bufB := make([]byte, 64*1024), make([]byte, 64*1024)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if na != nb || !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+func entrySize(fi os.FileInfo) int64 {
+	if fi.Mode().IsRegular() {
+		return fi.Size()
+	}
+	return 0
+}
@@ -0,0 +1,133 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestDiffTrees(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local-btrfs-diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	from, to := path.Join(dir, "from"), path.Join(dir, "to")
+	writeTree(t, from, map[string]string{
+		"unchanged":     "same",
+		"modified":      "abc",
+		"resized":       "abc",
+		"gone/file":     "x",
+		"kept/file":     "y",
+		"kept/old-file": "z",
+	})
+	writeTree(t, to, map[string]string{
+		"unchanged":     "same",
+		"modified":      "xyz",
+		"resized":       "abcdef",
+		"kept/file":     "y",
+		"kept/new-file": "new",
+		"new/file":      "n",
+	})
+	os.Symlink("unchanged", path.Join(from, "link"))
+	os.Symlink("modified", path.Join(to, "link"))
+
+	entries, err := diffTrees(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []DiffEntry{
+		{Path: "gone", Change: DiffDeleted, Dir: true},
+		{Path: "gone/file", Change: DiffDeleted, Size: 1},
+		{Path: "kept/new-file", Change: DiffAdded, Size: 3},
+		{Path: "kept/old-file", Change: DiffDeleted, Size: 1},
+		{Path: "link", Change: DiffModified},
+		{Path: "modified", Change: DiffModified, Size: 3, OldSize: 3},
+		{Path: "new", Change: DiffAdded, Dir: true},
+		{Path: "new/file", Change: DiffAdded, Size: 1},
+		{Path: "resized", Change: DiffModified, Size: 6, OldSize: 3},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected\n%+v\ngot\n%+v", expected, entries)
+	}
+}
+
+func TestChanged_sameInode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local-btrfs-diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a hard link has the inode and times of the original, like an unchanged
+	// file in a snapshot
+	writeTree(t, dir, map[string]string{"file": "abc", "copy": "abc"})
+	if err := os.Link(path.Join(dir, "file"), path.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	file, _ := os.Lstat(path.Join(dir, "file"))
+	link, _ := os.Lstat(path.Join(dir, "link"))
+	copied, _ := os.Lstat(path.Join(dir, "copy"))
+
+	// the contents of the same inode aren't read, the paths don't exist
+	if changed(file, link, path.Join(dir, "missing"), path.Join(dir, "missing")) {
+		t.Error("Expected same inode to be unchanged")
+	}
+	if changed(file, copied, path.Join(dir, "file"), path.Join(dir, "copy")) {
+		t.Error("Expected copy with the same content to be unchanged")
+	}
+	if !changed(file, copied, path.Join(dir, "missing"), path.Join(dir, "copy")) {
+		t.Error("Expected content of another inode to be compared")
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	defaultCreateHelper(driver, t)
+	defer defaultCleanupHelper(driver, t)
+
+	current := defaultTestMountpoint + "/current"
+	ioutil.WriteFile(current+"/file", []byte("before"), 0644)
+	driver.createSnap(defaultTestName, "snap1", SnapshotMeta{})
+	ioutil.WriteFile(current+"/added", []byte("new"), 0644)
+	driver.createSnap(defaultTestName, "snap2", SnapshotMeta{})
+	os.Remove(current + "/file")
+
+	report, err := driver.diffSnapshots(defaultTestName, "snap1", "snap2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []DiffEntry{{Path: "added", Change: DiffAdded, Size: 3}}; !reflect.DeepEqual(report.Entries, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, report.Entries)
+	}
+
+	report, err = driver.diffSnapshots(defaultTestName, "snap2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.To != "current" || len(report.Entries) != 1 || report.Entries[0].Change != DiffDeleted {
+		t.Errorf("Unexpected diff against current %+v", report)
+	}
+
+	if _, err := driver.diffSnapshots(defaultTestName, "unknown", ""); err == nil {
+		t.Error("Expected error for unknown snapshot")
+	}
+}
+
+func writeTree(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		p := path.Join(root, name)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -1,88 +1,170 @@
 package daemon
 
 import (
-	"encoding/json"
+	"bufio"
+	"compress/gzip"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path"
-	"strconv"
+	"sort"
 	"sync"
+	"time"
+	"unsafe"
 
 	"errors"
 	"github.com/docker/go-plugins-helpers/volume"
-	"github.com/fatih/color"
-	"os/exec"
-	"strings"
+	"golang.org/x/sys/unix"
 )
 
-var (
-	yellow  = color.New(color.FgYellow).SprintfFunc()
-	cyan    = color.New(color.FgCyan).SprintfFunc()
-	blue    = color.New(color.FgBlue).SprintfFunc()
-	magenta = color.New(color.FgMagenta).SprintfFunc()
-	white   = color.New(color.FgWhite).SprintfFunc()
-)
+type LocalBtrfsDriver struct {
+	volumes   map[string]string
+	schedules map[string]*SnapshotSchedule
+	hooks     map[string]*SnapshotHooks
+	sizes     map[string]uint64
+	mounts    map[string][]string
+	mutex     *sync.RWMutex
+	metaMutex *sync.Mutex
+	backend   Backend
+	config    Config
+	Name      string
+
+	// defaultSchedule is used for volumes created without snapshot options.
+	defaultSchedule *SnapshotSchedule
+	// defaultHooks are used for volumes created without hook options.
+	defaultHooks *SnapshotHooks
+}
 
-const (
-	stateDir  = "/var/lib/docker/plugin-data/"
-	stateFile = "local-btrfs.json"
-)
+// volumeOptions are the optional settings of a volume given on creation.
+type volumeOptions struct {
+	schedule *SnapshotSchedule
+	hooks    *SnapshotHooks
+	size     uint64
 
-type LocalBtrfsDriver struct {
-	volumes map[string]string
-	mutex   *sync.Mutex
-	debug   bool
-	Name    string
+	// fromVolume and fromSnapshot make the volume a writable clone of a
+	// snapshot, or of the current state if fromSnapshot is empty.
+	fromVolume   string
+	fromSnapshot string
 }
 
-type saveData struct {
-	State map[string]string `json:"state"`
+func parseVolumeOptions(options map[string]string) (volumeOptions, error) {
+	schedule, err := parseSchedule(options)
+	if err != nil {
+		return volumeOptions{}, err
+	}
+
+	hooks, err := parseHooks(options)
+	if err != nil {
+		return volumeOptions{}, err
+	}
+
+	var size uint64
+	if value, ok := options["size"]; ok {
+		if size, err = parseSize(value); err != nil {
+			return volumeOptions{}, err
+		}
+	}
+
+	fromVolume := options["from_volume"]
+	fromSnapshot := options["from_snapshot"]
+	if fromSnapshot != "" && fromVolume == "" {
+		return volumeOptions{}, errors.New("The `from_snapshot` option requires the `from_volume` option")
+	}
+
+	return volumeOptions{schedule: schedule, hooks: hooks, size: size, fromVolume: fromVolume, fromSnapshot: fromSnapshot}, nil
 }
 
-func NewLocalBtrfsDriver() LocalBtrfsDriver {
-	fmt.Printf(white("%-18s", "Starting... "))
+func NewLocalBtrfsDriver(config Config) LocalBtrfsDriver {
+	defaultSchedule, err := config.Snapshots.schedule()
+	if err != nil {
+		log.Fatalf("Invalid snapshot defaults: %v", err)
+	}
+	defaultHooks, err := config.Hooks.hooks()
+	if err != nil {
+		log.Fatalf("Invalid hook defaults: %v", err)
+	}
+
+	backend, err := newBackend(config.Backend)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	driver := LocalBtrfsDriver{
-		volumes: map[string]string{},
-		mutex:   &sync.Mutex{},
-		debug:   true,
-		Name:    "local-btrfs",
+		volumes:         map[string]string{},
+		schedules:       map[string]*SnapshotSchedule{},
+		hooks:           map[string]*SnapshotHooks{},
+		sizes:           map[string]uint64{},
+		mounts:          map[string][]string{},
+		mutex:           &sync.RWMutex{},
+		metaMutex:       &sync.Mutex{},
+		backend:         metricsBackend{backend},
+		config:          config,
+		Name:            config.PluginName,
+		defaultSchedule: defaultSchedule,
+		defaultHooks:    defaultHooks,
 	}
 
-	os.MkdirAll(stateDir, 0700)
+	os.MkdirAll(config.StateDir, 0700)
 
-	_, driver.volumes = driver.findExistingVolumesFromStateFile()
-	fmt.Printf("Found %s volumes on startup\n", yellow(strconv.Itoa(len(driver.volumes))))
+	err, data := driver.findExistingVolumesFromStateFile()
+	if err != nil {
+		// starting with an empty state would overwrite the state file
+		log.Fatalf("Could not load state file: %v", err)
+	}
+	driver.loadStateData(data)
+	for volumeName, volumePath := range driver.volumes {
+		if err := driver.cleanupRestore(volumePath); err != nil {
+			logger.With(Fields{"volume": volumeName}).WithError(err).Warn("could not clean up interrupted restore")
+		}
+	}
+	logger.With(Fields{"volumes": len(driver.volumes), "state_file": config.statePath()}).Info("started")
 
 	return driver
 }
 
 func (driver LocalBtrfsDriver) Get(req volume.Request) volume.Response {
-	fmt.Print(white("%-18s", "Get Called... "))
+	l := logger.With(Fields{"operation": "get", "volume": req.Name})
+
+	if _, _, ok := splitSnapshotVolume(req.Name); ok {
+		vol, err := driver.snapshotVolume(req.Name)
+		if err != nil {
+			l.WithError(err).Debug("snapshot volume not found")
+			return volume.Response{Err: err.Error()}
+		}
+		l.Debug("found snapshot volume")
+		return volume.Response{Volume: vol}
+	}
 
-	if driver.exists(req.Name) {
-		fmt.Printf("Found %s\n", cyan(req.Name))
+	if _, err := driver.getVolumePath(req.Name); err == nil {
+		l.Debug("found volume")
 		return volume.Response{
 			Volume: driver.volume(req.Name),
 		}
 	}
 
-	fmt.Printf("Couldn't find %s\n", cyan(req.Name))
+	l.Debug("volume not found")
 	return volume.Response{
-		Err: fmt.Sprintf("No volume found with the name %s", cyan(req.Name)),
+		Err: fmt.Sprintf("No volume found with the name %s", req.Name),
 	}
 }
 
 func (driver LocalBtrfsDriver) List(req volume.Request) volume.Response {
-	fmt.Print(white("%-18s", "List Called... "))
-
+	// docker lists volumes often, the status is only determined by Get
 	var volumes []*volume.Volume
-	for name := range driver.volumes {
-		volumes = append(volumes, driver.volume(name))
+	for _, name := range driver.volumeNames() {
+		volumePath, err := driver.getVolumePath(name)
+		if err != nil {
+			continue
+		}
+		volumes = append(volumes, &volume.Volume{Name: name, Mountpoint: volumePath + "/current"})
+	}
+	if driver.config.ListSnapshots {
+		volumes = append(volumes, driver.snapshotVolumes()...)
 	}
 
-	fmt.Printf("Found %s volumes\n", yellow(strconv.Itoa(len(volumes))))
+	logger.With(Fields{"operation": "list", "volumes": len(volumes)}).Debug("listed volumes")
 
 	return volume.Response{
 		Volumes: volumes,
@@ -90,174 +172,301 @@ func (driver LocalBtrfsDriver) List(req volume.Request) volume.Response {
 }
 
 func (driver LocalBtrfsDriver) Create(req volume.Request) volume.Response {
-	fmt.Print(white("%-18s", "Create Called... "))
+	// docker may create volumes it doesn't know before using them
+	if _, _, ok := splitSnapshotVolume(req.Name); ok {
+		if len(req.Options) > 0 {
+			return volume.Response{Err: "snapshot volumes don't take options"}
+		}
+		if _, err := driver.mountPath(req.Name); err != nil {
+			return volume.Response{Err: err.Error()}
+		}
+		return volume.Response{}
+	}
 
-	mountpoint := req.Options["mountpoint"]
-	if mountpoint == "" {
-		fmt.Printf("No %s option provided\n", blue("mountpoint"))
-		return volume.Response{Err: "The `mountpoint` option is required"}
+	mountpoint, err := driver.config.resolveMountpoint(req.Name, req.Options["mountpoint"], req.Options["root"])
+	if err != nil {
+		logger.With(Fields{"operation": "create", "volume": req.Name}).WithError(err).Error("no mountpoint for volume")
+		return volume.Response{Err: err.Error()}
 	}
 
-	if err := driver.createVolume(req.Name, mountpoint); err != nil {
+	options, err := parseVolumeOptions(req.Options)
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+
+	if err := driver.createVolume(req.Name, mountpoint, options); err != nil {
 		return volume.Response{Err: err.Error()}
 	}
 
 	return volume.Response{}
 }
 
-func (driver LocalBtrfsDriver) createVolume(name string, mountpoint string) error {
-	fmt.Print(white("%-18s", "Create Called... "))
+func (driver LocalBtrfsDriver) createVolume(name string, mountpoint string, options volumeOptions) (err error) {
+	defer logOperation("create", Fields{"volume": name, "mountpoint": mountpoint}, time.Now(), &err)
 
 	driver.mutex.Lock()
 	defer driver.mutex.Unlock()
 
+	if err := validateVolumeName(name); err != nil {
+		return err
+	}
+
 	if driver.exists(name) {
 		return errors.New(fmt.Sprintf("The volume %s already exists", name))
 	}
 
-	if err := os.MkdirAll(mountpoint, 0700); err != nil {
-		fmt.Printf("%17s Could not create directory %s\n", " ", magenta(mountpoint))
+	if err := driver.config.Hooks.checkHooks(options.hooks); err != nil {
+		return err
+	}
+
+	clonePath, err := driver.cloneSourcePath(options)
+	if err != nil {
 		return err
 	}
-	fmt.Printf("Ensuring directory %s exists on host...\n", magenta(mountpoint))
 
-	snapdir := mountpoint + "/snaps"
-	if err := os.MkdirAll(snapdir, 0700); err != nil {
-		fmt.Printf("%17s Could not create directory %s\n", " ", magenta(snapdir))
+	// undo the completed steps in reverse order if a later one fails, so
+	// the create can be retried
+	var rollback []func() error
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(rollback) - 1; i >= 0; i-- {
+			if rollbackErr := rollback[i](); rollbackErr != nil {
+				logger.With(Fields{"volume": name}).WithError(rollbackErr).Error("could not roll back create")
+			}
+		}
+	}()
+
+	if _, err := os.Stat(mountpoint); os.IsNotExist(err) {
+		rollback = append(rollback, func() error { return os.RemoveAll(mountpoint) })
+	}
+	if err := os.MkdirAll(mountpoint+"/snaps", 0700); err != nil {
 		return err
 	}
 
 	filename := mountpoint + "/current"
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		if err := callBtrfs("subvolume", "create", filename); err != nil {
+	if clonePath != "" {
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			return errors.New(fmt.Sprintf("can't clone into existing subvolume %s", filename))
+		}
+		logger.With(Fields{"volume": name, "source": clonePath}).Debug("cloning")
+		if err := driver.backend.SnapshotSubvolume(clonePath, filename, false); err != nil {
 			return err
 		}
+		rollback = append(rollback, func() error { return driver.backend.DeleteSubvolume(filename) })
+	} else if _, err := os.Stat(filename); os.IsNotExist(err) {
+		if err := driver.backend.CreateSubvolume(filename); err != nil {
+			return err
+		}
+		rollback = append(rollback, func() error { return driver.backend.DeleteSubvolume(filename) })
 	}
 
-	driver.volumes[name] = mountpoint
-	if err := driver.saveState(driver.volumes); err != nil {
-		fmt.Println(err.Error())
+	if options.size > 0 {
+		if err := driver.applySizeLimit(mountpoint, options.size); err != nil {
+			return err
+		}
+		driver.sizes[name] = options.size
 	}
 
-	fmt.Printf("%17s Created volume %s with mountpoint %s\n", " ", cyan(name), magenta(mountpoint))
+	driver.volumes[name] = mountpoint
+	if options.schedule != nil {
+		driver.schedules[name] = options.schedule
+	} else if driver.defaultSchedule != nil {
+		schedule := *driver.defaultSchedule
+		driver.schedules[name] = &schedule
+	}
+	if options.hooks != nil {
+		driver.hooks[name] = options.hooks
+	}
+	if err := driver.saveState(); err != nil {
+		logger.WithError(err).Error("could not save state")
+	}
 
 	return nil
 }
 
+// cloneSourcePath returns the subvolume a new volume is cloned from, or "" if
+// it is not a clone.
+func (driver LocalBtrfsDriver) cloneSourcePath(options volumeOptions) (string, error) {
+	if options.fromVolume == "" {
+		return "", nil
+	}
+
+	volumePath, exists := driver.volumes[options.fromVolume]
+	if !exists {
+		return "", errors.New("volume " + options.fromVolume + " does not exist")
+	}
+
+	if options.fromSnapshot == "" {
+		return volumePath + "/current", nil
+	}
+
+	snapPath, err := driver.getSnapshotPath(volumePath, options.fromSnapshot)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(snapPath); os.IsNotExist(err) {
+		return "", errors.New(fmt.Sprintf("snapshot %q does not exist for volume %q (%v)", options.fromSnapshot, options.fromVolume, snapPath))
+	}
+	return snapPath, nil
+}
+
 func (driver LocalBtrfsDriver) Remove(req volume.Request) volume.Response {
-	driver.removeVolume(req.Name, false)
+	if _, _, ok := splitSnapshotVolume(req.Name); ok {
+		if err := driver.removeSnapshotVolume(req.Name); err != nil {
+			return volume.Response{Err: err.Error()}
+		}
+		return volume.Response{}
+	}
+
+	// errors are logged, docker may forget the volume anyway
+	driver.removeVolume(req.Name, false, false)
 	return volume.Response{}
 }
 
 func (driver LocalBtrfsDriver) Mount(req volume.MountRequest) volume.Response {
-	fmt.Print(white("%-18s", "Mount Called... "))
+	l := logger.With(Fields{"operation": "mount", "volume": req.Name, "id": req.ID})
+
+	if err := driver.addMount(req.Name, req.ID); err != nil {
+		l.WithError(err).Error("could not mount volume")
+		return volume.Response{Err: err.Error()}
+	}
 
-	fmt.Printf("Mounted %s\n", cyan(req.Name))
+	l.With(Fields{"mounts": driver.mountCount(req.Name)}).Info("mounted volume")
 
 	return driver.Path(volume.Request{Name: req.Name})
 }
 
 func (driver LocalBtrfsDriver) Path(req volume.Request) volume.Response {
-	fmt.Print(white("%-18s", "Path Called... "))
-
-	mpoint := driver.volumes[req.Name] + "/current"
-	fmt.Printf("Returned path %s\n", magenta(mpoint))
+	mpoint, err := driver.mountPath(req.Name)
+	if err != nil {
+		logger.With(Fields{"operation": "path", "volume": req.Name}).WithError(err).Debug("no path")
+		return volume.Response{Err: err.Error()}
+	}
+	logger.With(Fields{"operation": "path", "volume": req.Name, "path": mpoint}).Debug("returned path")
 
 	return volume.Response{Mountpoint: mpoint}
 }
 
 func (driver LocalBtrfsDriver) Unmount(req volume.UnmountRequest) volume.Response {
-	fmt.Print(white("%-18s", "Unmount Called... "))
+	l := logger.With(Fields{"operation": "unmount", "volume": req.Name, "id": req.ID})
 
-	fmt.Printf("Unmounted %s\n", cyan(req.Name))
+	if err := driver.removeMount(req.Name, req.ID); err != nil {
+		l.WithError(err).Error("could not save state")
+	}
+
+	l.With(Fields{"mounts": driver.mountCount(req.Name)}).Info("unmounted volume")
 
 	return driver.Path(volume.Request{Name: req.Name})
 }
 
 func (driver LocalBtrfsDriver) Capabilities(req volume.Request) volume.Response {
-	fmt.Print(white("%-18s", "Capabilities Called... "))
-
 	return volume.Response{
 		Capabilities: volume.Capability{Scope: "local"},
 	}
 }
 
+// volumeNames returns the names of all volumes sorted.
+func (driver LocalBtrfsDriver) volumeNames() []string {
+	driver.mutex.RLock()
+	var names []string
+	for name := range driver.volumes {
+		names = append(names, name)
+	}
+	driver.mutex.RUnlock()
+
+	sort.Strings(names)
+	return names
+}
+
+// exists reports whether the volume is known. The caller holds the mutex.
 func (driver LocalBtrfsDriver) exists(name string) bool {
 	return driver.volumes[name] != ""
 }
 
 func (driver LocalBtrfsDriver) volume(name string) *volume.Volume {
+	info, err := driver.volumeInfo(name)
+	if err != nil {
+		logger.With(Fields{"volume": name}).WithError(err).Warn("could not determine status")
+	}
+
+	driver.mutex.RLock()
+	mountpoint := driver.volumes[name] + "/current"
+	driver.mutex.RUnlock()
+
 	return &volume.Volume{
 		Name:       name,
-		Mountpoint: driver.volumes[name] + "/current",
+		Mountpoint: mountpoint,
+		Status:     info.status(),
 	}
 }
 
-func (driver LocalBtrfsDriver) findExistingVolumesFromStateFile() (error, map[string]string) {
-	p := path.Join(stateDir, stateFile)
-	fileData, err := ioutil.ReadFile(p)
+func (driver LocalBtrfsDriver) findExistingVolumesFromStateFile() (error, stateData) {
+	data, err := readStateFile(driver.config.statePath())
 	if err != nil {
-		return err, map[string]string{}
-	}
-
-	var data saveData
-	e := json.Unmarshal(fileData, &data)
-	if e != nil {
-		return e, map[string]string{}
+		return err, newStateData()
 	}
+	return nil, data
+}
 
-	return nil, data.State
+func (driver LocalBtrfsDriver) saveState() error {
+	return writeStateFile(driver.config.statePath(), driver.stateData())
 }
 
-func (driver LocalBtrfsDriver) saveState(volumes map[string]string) error {
-	data := saveData{
-		State: volumes,
-	}
+func (driver LocalBtrfsDriver) removeVolume(volumeName string, purge bool, force bool) (err error) {
+	defer logOperation("remove", Fields{"volume": volumeName, "purge": purge}, time.Now(), &err)
+
+	driver.mutex.Lock()
+	defer driver.mutex.Unlock()
 
-	fileData, err := json.Marshal(data)
+	volumePath, err := driver.getVolumePathLocked(volumeName)
 	if err != nil {
 		return err
 	}
 
-	p := path.Join(stateDir, stateFile)
-	return ioutil.WriteFile(p, fileData, 0600)
-}
-
-func (driver LocalBtrfsDriver) removeVolume(volumeName string, purge bool) error {
-	// TODO: check if mounted and return warn/error
-
-	volumePath, exists := driver.volumes[volumeName]
-	if !exists {
-		return errors.New("volume " + volumeName + " does not exist")
-	}
-
 	if purge {
-		snaps, err := driver.listSnapshots(volumeName)
+		if err := driver.checkNotMounted(volumeName, force); err != nil {
+			return err
+		}
+		if err := driver.checkSnapshotsNotMounted(volumeName, force); err != nil {
+			return err
+		}
+
+		snaps, err := listSnapshotDir(volumeName, volumePath)
 		if err != nil {
 			return err
 		}
+		// the volume is kept if a snapshot remains, so the removal can be
+		// retried
 		for _, snap := range snaps {
-			driver.removeSnap(volumeName, snap)
+			if err := driver.removeSnapLocked(volumeName, snap, force); err != nil {
+				return errors.New(fmt.Sprintf("could not remove snapshot %q: %v", snap, err))
+			}
 		}
 
 		currentPath := volumePath + "/current"
-		if err := callBtrfs("subvolume", "delete", currentPath); err != nil {
+		if err := driver.backend.DeleteSubvolume(currentPath); err != nil {
 			return err
 		}
 
 		os.RemoveAll(volumePath)
 	}
 
-	driver.mutex.Lock()
-	defer driver.mutex.Unlock()
-
 	delete(driver.volumes, volumeName)
-
-	if err := driver.saveState(driver.volumes); err != nil {
-		fmt.Println(err.Error())
+	delete(driver.schedules, volumeName)
+	delete(driver.hooks, volumeName)
+	delete(driver.sizes, volumeName)
+	delete(driver.mounts, volumeName)
+	for name := range driver.mounts {
+		if parent, _, ok := splitSnapshotVolume(name); ok && parent == volumeName {
+			delete(driver.mounts, name)
+		}
 	}
 
-	fmt.Printf("Removed %s\n", cyan(volumeName))
+	if err := driver.saveState(); err != nil {
+		logger.WithError(err).Error("could not save state")
+	}
 
 	return nil
 }
@@ -267,21 +476,38 @@ func (driver LocalBtrfsDriver) listSnapshots(volumeName string) ([]string, error
 	if err != nil {
 		return nil, err
 	}
+	return listSnapshotDir(volumeName, volumePath)
+}
 
+// listSnapshotDir returns the snapshots in the snaps directory of the volume
+// at volumePath.
+func listSnapshotDir(volumeName string, volumePath string) ([]string, error) {
 	files, err := ioutil.ReadDir(volumePath + "/snaps")
 	if err != nil {
 		return nil, err
 	}
 
-	snaps := make([]string, len(files))
-	for i, fi := range files {
-		snaps[i] = fi.Name()
+	snaps := make([]string, 0, len(files))
+	for _, fi := range files {
+		// e.g. created with btrfs directly, they can't be addressed
+		if err := validateSnapshotName(fi.Name()); err != nil {
+			logger.With(Fields{"volume": volumeName}).WithError(err).Warn("ignoring snapshot")
+			continue
+		}
+		snaps = append(snaps, fi.Name())
 	}
 
 	return snaps, nil
 }
 
 func (driver *LocalBtrfsDriver) getVolumePath(volumeName string) (string, error) {
+	driver.mutex.RLock()
+	defer driver.mutex.RUnlock()
+	return driver.getVolumePathLocked(volumeName)
+}
+
+// getVolumePathLocked is getVolumePath for callers holding the mutex.
+func (driver *LocalBtrfsDriver) getVolumePathLocked(volumeName string) (string, error) {
 	volumePath, exists := driver.volumes[volumeName]
 	if !exists {
 		return "", errors.New("volume " + volumeName + " does not exist")
@@ -289,89 +515,539 @@ func (driver *LocalBtrfsDriver) getVolumePath(volumeName string) (string, error)
 	return volumePath, nil
 }
 
-func (driver LocalBtrfsDriver) createSnap(volumeName string, snapshotName string) error {
-	// TODO: check if mounted and return warn/error
+// createSnap takes a read-only snapshot of the current state and records
+// its metadata. The creation time is set if meta doesn't have one. The
+// snapshot is taken between the pre- and post-snapshot hooks of the volume.
+// A failing pre-snapshot hook aborts the snapshot, the post-snapshot hook
+// runs anyway, e.g. to resume what the pre-snapshot hook paused.
+func (driver LocalBtrfsDriver) createSnap(volumeName string, snapshotName string, meta SnapshotMeta) (err error) {
+	defer logOperation("create-snapshot", Fields{"volume": volumeName, "snapshot": snapshotName}, time.Now(), &err)
 
-	volumePath, exists := driver.volumes[volumeName]
-	if !exists {
-		return errors.New("volume " + volumeName + " does not exist")
+	// snapshots of mounted volumes are fine, they are crash-consistent, hooks
+	// can make them application-consistent
+
+	volumePath, err := driver.getVolumePath(volumeName)
+	if err != nil {
+		return err
 	}
 
-	snapPath := driver.getSnapshotPath(volumePath, snapshotName)
+	snapPath, err := driver.getSnapshotPath(volumePath, snapshotName)
+	if err != nil {
+		return err
+	}
 	if _, err := os.Stat(snapPath); !os.IsNotExist(err) {
 		return errors.New(fmt.Sprintf("snapshot %q already exists for volume %q (%v)", snapshotName, volumeName, snapPath))
 	}
 
 	srcPath := volumePath + "/current"
-	fmt.Printf("creating snapshot of volume %v as %v: %v -> %v\n", volumeName, snapshotName, srcPath, snapPath)
-	if err := callBtrfs("subvolume", "snapshot", "-r", srcPath, snapPath); err != nil {
+	hooks := driver.snapshotHooks(volumeName)
+	env := driver.hookEnv(volumeName, snapshotName, srcPath)
+	defer func() {
+		if hookErr := driver.runSnapshotHook(hooks, hookPostSnapshot, env); hookErr != nil && err == nil {
+			err = errors.New(fmt.Sprintf("snapshot %q was taken, but %v", snapshotName, hookErr))
+		}
+	}()
+	if err := driver.runSnapshotHook(hooks, hookPreSnapshot, env); err != nil {
+		return err
+	}
+
+	if err := driver.backend.SnapshotSubvolume(srcPath, snapPath, true); err != nil {
 		return err
 	}
 
+	driver.recordSnapshot(volumePath, snapshotName, meta)
 	return nil
 }
 
 func (driver LocalBtrfsDriver) removeSnap(volumeName string, snapshotName string) error {
-	// TODO: check if mounted and return warn/error
+	driver.mutex.Lock()
+	defer driver.mutex.Unlock()
+	return driver.removeSnapLocked(volumeName, snapshotName, false)
+}
 
-	volumePath, exists := driver.volumes[volumeName]
-	if !exists {
-		return errors.New("volume " + volumeName + " does not exist")
+// removeSnapLocked is removeSnap for callers holding the mutex. With force
+// the snapshot is removed even if it's mounted as volume.
+func (driver LocalBtrfsDriver) removeSnapLocked(volumeName string, snapshotName string, force bool) (err error) {
+	defer logOperation("remove-snapshot", Fields{"volume": volumeName, "snapshot": snapshotName}, time.Now(), &err)
+
+	volumePath, err := driver.getVolumePathLocked(volumeName)
+	if err != nil {
+		return err
+	}
+
+	// containers using the snapshot as volume would lose their files
+	if err := driver.checkNotMounted(snapshotVolumeName(volumeName, snapshotName), force); err != nil {
+		return err
 	}
 
-	snapPath := driver.getSnapshotPath(volumePath, snapshotName)
+	snapPath, err := driver.getSnapshotPath(volumePath, snapshotName)
+	if err != nil {
+		return err
+	}
 	if _, err := os.Stat(snapPath); os.IsNotExist(err) {
 		return errors.New(fmt.Sprintf("snapshot %q does not exist for volume %q (%v)", snapshotName, volumeName, snapPath))
 	}
 
-	fmt.Printf("removing snapshot %v of volume %v in %v\n", snapshotName, volumeName, snapPath)
-	if err := callBtrfs("subvolume", "delete", snapPath); err != nil {
+	if err := driver.backend.DeleteSubvolume(snapPath); err != nil {
 		return err
 	}
 
+	driver.forgetSnapshot(volumePath, snapshotName)
+	return nil
+}
+
+// cleanupRestore removes the leftovers of a restore of the volume at
+// volumePath that didn't complete, e.g. because the daemon crashed. As
+// current is swapped in one step, .restore-new is either the unused copy of
+// the snapshot or the replaced state. Restores of earlier versions renamed
+// current to .restore-old first, it's moved back if current is missing.
+func (driver LocalBtrfsDriver) cleanupRestore(volumePath string) error {
+	currentPath := volumePath + "/current"
+	replacedPath := volumePath + "/.restore-old"
+	if _, err := os.Lstat(replacedPath); err == nil {
+		if _, err := os.Lstat(currentPath); os.IsNotExist(err) {
+			if err := os.Rename(replacedPath, currentPath); err != nil {
+				return err
+			}
+		} else if err := driver.backend.DeleteSubvolume(replacedPath); err != nil {
+			return err
+		}
+	}
+
+	restoredPath := volumePath + "/.restore-new"
+	if _, err := os.Lstat(restoredPath); err == nil {
+		return driver.backend.DeleteSubvolume(restoredPath)
+	}
 	return nil
 }
 
-func (driver LocalBtrfsDriver) restoreSnap(volumeName string, snapshotName string) error {
-	// TODO: check if mounted and return warn/error
+// preRestoreSnapPrefix names the snapshots of the previous state of restored
+// volumes. Unlike scheduled snapshots they are never pruned.
+const preRestoreSnapPrefix = "pre-restore-"
 
-	fmt.Printf("Restoring snapshot %v in volume %v", snapshotName, volumeName)
+// renameExchange is the RENAME_EXCHANGE flag of renameat2.
+const renameExchange = 1 << 1
 
-	volumePath, exists := driver.volumes[volumeName]
-	if !exists {
-		return errors.New("volume " + volumeName + " does not exist")
+// exchangeSubvolumes swaps the paths a and b in one step, so there is no
+// moment in which either is missing. It's replaced in tests to inject
+// failures.
+var exchangeSubvolumes = func(a string, b string) error {
+	pa, err := unix.BytePtrFromString(a)
+	if err != nil {
+		return err
+	}
+	pb, err := unix.BytePtrFromString(b)
+	if err != nil {
+		return err
+	}
+	cwd := unix.AT_FDCWD
+	_, _, errno := unix.Syscall6(unix.SYS_RENAMEAT2, uintptr(cwd), uintptr(unsafe.Pointer(pa)), uintptr(cwd), uintptr(unsafe.Pointer(pb)), renameExchange, 0)
+	if errno != 0 {
+		return &os.LinkError{Op: "exchange", Old: a, New: b, Err: errno}
+	}
+	return nil
+}
+
+func preRestoreSnapName(t time.Time) string {
+	return preRestoreSnapPrefix + t.UTC().Format(scheduledSnapFormat)
+}
+
+// restoreSnap replaces the current state of the volume with a writable copy
+// of the snapshot. Unless noBackup is set, the previous state is kept as a
+// pre-restore snapshot.
+func (driver LocalBtrfsDriver) restoreSnap(volumeName string, snapshotName string, force bool, noBackup bool) (err error) {
+	defer logOperation("restore-snapshot", Fields{"volume": volumeName, "snapshot": snapshotName}, time.Now(), &err)
+
+	backupName := ""
+	if !noBackup {
+		backupName = preRestoreSnapName(time.Now())
+	}
+	return driver.restoreSnapshot(volumeName, snapshotName, force, backupName, SnapshotMeta{
+		Description: fmt.Sprintf("before restoring %v", snapshotName),
+		Creator:     creatorPreRestore,
+	})
+}
+
+// restoreSnapshot restores the snapshot like restoreSnap. The copy is
+// created beside current and swapped with it in one step, so current is left
+// untouched if any step fails. The previous state is kept as snapshot
+// backupName with backupMeta, unless backupName is "".
+func (driver LocalBtrfsDriver) restoreSnapshot(volumeName string, snapshotName string, force bool, backupName string, backupMeta SnapshotMeta) (err error) {
+	// containers can't mount the volume until the restore is complete
+	driver.mutex.Lock()
+	defer driver.mutex.Unlock()
+
+	volumePath, err := driver.getVolumePathLocked(volumeName)
+	if err != nil {
+		return err
+	}
+
+	if err := driver.checkNotMounted(volumeName, force); err != nil {
+		return err
 	}
 
-	snapPath := driver.getSnapshotPath(volumePath, snapshotName)
+	snapPath, err := driver.getSnapshotPath(volumePath, snapshotName)
+	if err != nil {
+		return err
+	}
 	if _, err := os.Stat(snapPath); os.IsNotExist(err) {
 		return errors.New(fmt.Sprintf("snapshot %q does not exist for volume %q (%v)", snapshotName, volumeName, snapPath))
 	}
 
+	if err := driver.cleanupRestore(volumePath); err != nil {
+		return err
+	}
 	currentPath := volumePath + "/current"
+	restoredPath := volumePath + "/.restore-new"
+
+	// undo the completed steps in reverse order if a later one fails
+	var rollback []func() error
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(rollback) - 1; i >= 0; i-- {
+			if rollbackErr := rollback[i](); rollbackErr != nil {
+				logger.With(Fields{"volume": volumeName}).WithError(rollbackErr).Error("could not roll back restore")
+			}
+		}
+	}()
+
+	if err := driver.backend.SnapshotSubvolume(snapPath, restoredPath, false); err != nil {
+		return err
+	}
+	rollback = append(rollback, func() error { return driver.backend.DeleteSubvolume(restoredPath) })
+
+	// the limit belongs to the qgroup of the replaced subvolume
+	if size := driver.sizes[volumeName]; size > 0 {
+		if err := driver.backend.LimitSubvolume(restoredPath, size); err != nil {
+			return err
+		}
+	}
+
+	if backupName != "" {
+		backupPath, err := driver.getSnapshotPath(volumePath, backupName)
+		if err != nil {
+			return err
+		}
+		if err := driver.backend.SnapshotSubvolume(currentPath, backupPath, true); err != nil {
+			return err
+		}
+		rollback = append(rollback, func() error { return driver.backend.DeleteSubvolume(backupPath) })
+	}
+
+	if err := exchangeSubvolumes(restoredPath, currentPath); err != nil {
+		return err
+	}
+
+	// the restore is complete, the replaced state is at restoredPath now and
+	// removed by the next restore or start if this fails
+	if err := driver.backend.DeleteSubvolume(restoredPath); err != nil {
+		logger.With(Fields{"volume": volumeName, "path": restoredPath}).WithError(err).Warn("could not remove replaced subvolume")
+	}
+
+	if backupName != "" {
+		driver.recordSnapshot(volumePath, backupName, backupMeta)
+	}
+
+	return nil
+}
+
+func (driver LocalBtrfsDriver) sendSnap(volumeName string, snapshotName string, targetDir string) (err error) {
+	defer logOperation("send-snapshot", Fields{"volume": volumeName, "snapshot": snapshotName, "target": targetDir}, time.Now(), &err)
+
+	volumePath, err := driver.getVolumePath(volumeName)
+	if err != nil {
+		return err
+	}
+
+	snapPath, err := driver.getSnapshotPath(volumePath, snapshotName)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(snapPath); os.IsNotExist(err) {
+		return errors.New(fmt.Sprintf("snapshot %q does not exist for volume %q (%v)", snapshotName, volumeName, snapPath))
+	}
+
+	if fi, err := os.Stat(targetDir); err != nil || !fi.IsDir() {
+		return errors.New(fmt.Sprintf("target directory %v does not exist", targetDir))
+	}
+
+	if _, err := os.Stat(path.Join(targetDir, snapshotName)); !os.IsNotExist(err) {
+		return errors.New(fmt.Sprintf("snapshot %q already exists in %v", snapshotName, targetDir))
+	}
+
+	parentPath, err := driver.findCommonParent(volumeName, snapshotName, targetDir)
+	if err != nil {
+		return err
+	}
+
+	if parentPath != "" {
+		logger.With(Fields{"volume": volumeName, "snapshot": snapshotName, "parent": parentPath}).Info("sending incrementally")
+	} else {
+		logger.With(Fields{"volume": volumeName, "snapshot": snapshotName}).Info("sending full snapshot")
+	}
+
+	return sendReceive(driver.backend, snapPath, parentPath, targetDir)
+}
+
+// findCommonParent returns the path of the newest snapshot of the volume that
+// was already received in targetDir, or "" if there is none.
+func (driver LocalBtrfsDriver) findCommonParent(volumeName string, snapshotName string, targetDir string) (string, error) {
+	volumePath, err := driver.getVolumePath(volumeName)
+	if err != nil {
+		return "", err
+	}
+
+	snaps, err := driver.listSnapshots(volumeName)
+	if err != nil {
+		return "", err
+	}
+
+	parentPath := ""
+	parentGeneration := int64(-1)
+	for _, snap := range snaps {
+		if snap == snapshotName {
+			continue
+		}
+
+		targetPath := path.Join(targetDir, snap)
+		if _, err := os.Stat(targetPath); os.IsNotExist(err) {
+			continue
+		}
+
+		snapPath, err := driver.getSnapshotPath(volumePath, snap)
+		if err != nil {
+			return "", err
+		}
+		srcInfo, err := driver.backend.ShowSubvolume(snapPath)
+		if err != nil {
+			return "", err
+		}
+		targetInfo, err := driver.backend.ShowSubvolume(targetPath)
+		if err != nil {
+			continue
+		}
+
+		// only snapshots that were received from this exact source can be used as parent
+		if srcInfo.UUID == "" || targetInfo.ReceivedUUID != srcInfo.UUID {
+			continue
+		}
+
+		if srcInfo.Generation > parentGeneration {
+			parentGeneration = srcInfo.Generation
+			parentPath = snapPath
+		}
+	}
+
+	return parentPath, nil
+}
+
+func (driver LocalBtrfsDriver) exportSnap(volumeName string, snapshotName string, file string, compress bool) (err error) {
+	defer logOperation("export-snapshot", Fields{"volume": volumeName, "snapshot": snapshotName, "file": file}, time.Now(), &err)
+
+	volumePath, err := driver.getVolumePath(volumeName)
+	if err != nil {
+		return err
+	}
+
+	snapPath, err := driver.getSnapshotPath(volumePath, snapshotName)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(snapPath); os.IsNotExist(err) {
+		return errors.New(fmt.Sprintf("snapshot %q does not exist for volume %q (%v)", snapshotName, volumeName, snapPath))
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var out io.Writer = f
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(f)
+		out = zw
+	}
+
+	if err := driver.backend.Send(snapPath, "", out); err != nil {
+		os.Remove(file)
+		return err
+	}
+
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			os.Remove(file)
+			return err
+		}
+	}
+
+	return f.Sync()
+}
+
+func (driver LocalBtrfsDriver) importVolume(name string, mountpoint string, file string) (err error) {
+	defer logOperation("import", Fields{"volume": name, "mountpoint": mountpoint, "file": file}, time.Now(), &err)
+
+	driver.mutex.Lock()
+	defer driver.mutex.Unlock()
 
-	fmt.Printf("removing default subvolume %v\n", currentPath)
-	if err := callBtrfs("subvolume", "delete", currentPath); err != nil {
+	// names with "@" would be taken for snapshot volumes
+	if err := validateVolumeName(name); err != nil {
 		return err
 	}
+	if driver.exists(name) {
+		return errors.New(fmt.Sprintf("The volume %s already exists", name))
+	}
+
+	currentPath := mountpoint + "/current"
+	if _, err := os.Stat(currentPath); !os.IsNotExist(err) {
+		return errors.New(fmt.Sprintf("%v already exists", currentPath))
+	}
 
-	fmt.Printf("creating read-write snapshot %v -> %v\n", snapPath, currentPath)
-	if err := callBtrfs("subvolume", "snapshot", snapPath, currentPath); err != nil {
+	// undo the completed steps in reverse order if a later one fails, so a
+	// failed import can be retried
+	var rollback []func() error
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(rollback) - 1; i >= 0; i-- {
+			if rollbackErr := rollback[i](); rollbackErr != nil {
+				logger.With(Fields{"volume": name}).WithError(rollbackErr).Error("could not roll back import")
+			}
+		}
+	}()
+
+	if _, err := os.Stat(mountpoint); os.IsNotExist(err) {
+		rollback = append(rollback, func() error { return os.RemoveAll(mountpoint) })
+	} else if _, err := os.Stat(mountpoint + "/snaps"); os.IsNotExist(err) {
+		rollback = append(rollback, func() error { return os.Remove(mountpoint + "/snaps") })
+	}
+	if err := os.MkdirAll(mountpoint+"/snaps", 0700); err != nil {
 		return err
 	}
 
+	snapPath, err := driver.receiveSnapshot(mountpoint, file, "")
+	if err != nil {
+		return err
+	}
+	rollback = append(rollback, func() error { return driver.backend.DeleteSubvolume(snapPath) })
+	driver.recordSnapshot(mountpoint, path.Base(snapPath), SnapshotMeta{Creator: creatorImport})
+	rollback = append(rollback, func() error {
+		driver.forgetSnapshot(mountpoint, path.Base(snapPath))
+		return nil
+	})
+
+	if err := driver.backend.SnapshotSubvolume(snapPath, currentPath, false); err != nil {
+		return err
+	}
+
+	driver.volumes[name] = mountpoint
+	if err := driver.saveState(); err != nil {
+		logger.WithError(err).Error("could not save state")
+	}
+
 	return nil
 }
 
-func callBtrfs(args ...string) error {
-	cmd := exec.Command("btrfs", args...)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		msg := fmt.Sprintf("Btrfs call %v failed: %s\n%s", strings.Join(args, " "), err.Error(), string(output))
-		fmt.Print(msg)
-		return errors.New(msg)
+func (driver LocalBtrfsDriver) importSnap(volumeName string, file string, snapshotName string) (err error) {
+	defer logOperation("import-snapshot", Fields{"volume": volumeName, "file": file}, time.Now(), &err)
+
+	volumePath, err := driver.getVolumePath(volumeName)
+	if err != nil {
+		return err
+	}
+
+	if snapshotName != "" {
+		snapPath, err := driver.getSnapshotPath(volumePath, snapshotName)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(snapPath); !os.IsNotExist(err) {
+			return errors.New(fmt.Sprintf("snapshot %q already exists for volume %q (%v)", snapshotName, volumeName, snapPath))
+		}
 	}
+
+	snapPath, err := driver.receiveSnapshot(volumePath, file, snapshotName)
+	if err != nil {
+		return err
+	}
+	driver.recordSnapshot(volumePath, path.Base(snapPath), SnapshotMeta{Creator: creatorImport})
+
+	logger.With(Fields{"volume": volumeName, "snapshot": path.Base(snapPath)}).Info("imported snapshot")
+
 	return nil
 }
 
-func (driver LocalBtrfsDriver) getSnapshotPath(volumePath string, snapshotName string) string {
-	return volumePath + "/snaps/" + snapshotName
+// receiveSnapshot receives the (possibly gzip compressed) send stream in file
+// into the snaps directory of the volume at volumePath. The received snapshot
+// is renamed to snapshotName unless it is empty. Returns the snapshot path.
+func (driver LocalBtrfsDriver) receiveSnapshot(volumePath string, file string, snapshotName string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var in io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return "", err
+		}
+		defer zr.Close()
+		in = zr
+	}
+
+	// receive into a temporary directory first, as we don't know the name of
+	// the subvolume in the stream beforehand
+	tmpDir, err := ioutil.TempDir(volumePath, ".import-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpDir)
+
+	if err := driver.backend.Receive(in, tmpDir); err != nil {
+		return "", err
+	}
+
+	files, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		return "", err
+	}
+	if len(files) != 1 {
+		return "", errors.New(fmt.Sprintf("expected exactly one subvolume in %v, found %d", file, len(files)))
+	}
+
+	received := path.Join(tmpDir, files[0].Name())
+	if snapshotName == "" {
+		snapshotName = files[0].Name()
+	}
+
+	snapPath, err := driver.getSnapshotPath(volumePath, snapshotName)
+	if err != nil {
+		driver.backend.DeleteSubvolume(received)
+		return "", err
+	}
+	if _, err := os.Stat(snapPath); !os.IsNotExist(err) {
+		driver.backend.DeleteSubvolume(received)
+		return "", errors.New(fmt.Sprintf("snapshot %q already exists (%v)", snapshotName, snapPath))
+	}
+
+	if err := os.Rename(received, snapPath); err != nil {
+		driver.backend.DeleteSubvolume(received)
+		return "", err
+	}
+
+	return snapPath, nil
+}
+
+func (driver LocalBtrfsDriver) getSnapshotPath(volumePath string, snapshotName string) (string, error) {
+	if err := validateSnapshotName(snapshotName); err != nil {
+		return "", err
+	}
+	return volumePath + "/snaps/" + snapshotName, nil
 }
@@ -1,20 +1,25 @@
 package daemon
 
 import (
+	"errors"
+	"io/ioutil"
 	"os"
+	"path"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/docker/go-plugins-helpers/volume"
-	"os/exec"
 )
 
 var (
 	defaultTestName       = "test-volume"
-	defaultTestMountpoint = "/btrfs/local-btrfs-test"
+	defaultTestMountpoint = path.Join(os.TempDir(), "local-btrfs-test")
 )
 
 func TestCreate(t *testing.T) {
-	driver := NewLocalBtrfsDriver()
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
 
 	defaultCreateHelper(driver, t)
 
@@ -42,7 +47,8 @@ func TestCreate(t *testing.T) {
 }
 
 func TestGet(t *testing.T) {
-	driver := NewLocalBtrfsDriver()
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
 
 	defaultCreateHelper(driver, t)
 
@@ -50,12 +56,16 @@ func TestGet(t *testing.T) {
 	if res.Err != "" {
 		t.Error("Should have found a volume!")
 	}
+	if res.Volume.Status["Exists"] != true {
+		t.Errorf("Expected the status of the volume, got %+v", res.Volume.Status)
+	}
 
 	defaultCleanupHelper(driver, t)
 }
 
 func TestList(t *testing.T) {
-	driver := NewLocalBtrfsDriver()
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
 
 	name := defaultTestName + "2"
 	mountpoint := defaultTestMountpoint + "2"
@@ -63,7 +73,10 @@ func TestList(t *testing.T) {
 	defaultCreateHelper(driver, t)
 	res := driver.List(volume.Request{})
 	if len(res.Volumes) != 1 {
-		t.Error("Should have found 1 volume!")
+		t.Fatal("Should have found 1 volume!")
+	}
+	if vol := res.Volumes[0]; vol.Mountpoint != defaultTestMountpoint+"/current" || vol.Status != nil {
+		t.Errorf("Expected only name and mountpoint, got %+v", vol)
 	}
 
 	createHelper(driver, t, name, mountpoint)
@@ -77,7 +90,8 @@ func TestList(t *testing.T) {
 }
 
 func TestMountUnmountPath(t *testing.T) {
-	driver := NewLocalBtrfsDriver()
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
 
 	defaultCreateHelper(driver, t)
 
@@ -91,6 +105,391 @@ func TestMountUnmountPath(t *testing.T) {
 		unmountRes.Mountpoint == defaultTestMountpoint+"/current") {
 		t.Error("Mount, Unmount and Path should all return the same Mountpoint")
 	}
+
+	defaultCleanupHelper(driver, t)
+}
+
+func TestMountCountPreventsPurge(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	defaultCreateHelper(driver, t)
+
+	driver.Mount(volume.MountRequest{Name: defaultTestName, ID: "container1"})
+	driver.Mount(volume.MountRequest{Name: defaultTestName, ID: "container1"})
+	driver.Mount(volume.MountRequest{Name: defaultTestName, ID: "container2"})
+	if driver.mountCount(defaultTestName) != 2 {
+		t.Error("Should count each mount ID once")
+	}
+
+	if err := driver.removeVolume(defaultTestName, true, false); err == nil {
+		t.Error("Should not purge a mounted volume")
+	}
+
+	driver.Unmount(volume.UnmountRequest{Name: defaultTestName, ID: "container1"})
+	driver.Unmount(volume.UnmountRequest{Name: defaultTestName, ID: "container2"})
+	if driver.mountCount(defaultTestName) != 0 {
+		t.Error("Should have no mounts after unmounting")
+	}
+
+	// e.g. docker crashed before unmounting
+	driver.Mount(volume.MountRequest{Name: defaultTestName, ID: "container3"})
+	if err := driver.clearMounts(defaultTestName); err != nil {
+		t.Fatal(err)
+	}
+	if driver.mountCount(defaultTestName) != 0 {
+		t.Error("Should have no mounts after clearing them")
+	}
+	if err := driver.clearMounts("unknown"); err == nil {
+		t.Error("Expected error for unknown volume")
+	}
+
+	defaultCleanupHelper(driver, t)
+}
+
+func TestRemoveVolume_purgeSnapshots(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	defaultCreateHelper(driver, t)
+	driver.createSnap(defaultTestName, "snap1", SnapshotMeta{})
+	driver.createSnap(defaultTestName, "snap2", SnapshotMeta{})
+
+	backend := driver.backend
+	driver.backend = failingBackend{Backend: backend, fail: func(op string, p string) bool {
+		return op == "delete" && p == defaultTestMountpoint+"/snaps/snap2"
+	}}
+	if err := driver.removeVolume(defaultTestName, true, false); err == nil {
+		t.Fatal("Expected purge to fail if a snapshot can't be removed")
+	}
+	if _, err := driver.getVolumePath(defaultTestName); err != nil {
+		t.Error("Expected the volume to be kept:", err)
+	}
+	if _, err := os.Stat(defaultTestMountpoint + "/current"); err != nil {
+		t.Error("Expected the current state to be kept:", err)
+	}
+
+	// forced, snapshots mounted as volumes are removed, too
+	driver.backend = backend
+	driver.Mount(volume.MountRequest{Name: snapshotVolumeName(defaultTestName, "snap2"), ID: "container1"})
+	if err := driver.removeVolume(defaultTestName, true, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(defaultTestMountpoint); !os.IsNotExist(err) {
+		t.Errorf("Expected %v to be removed, got %v", defaultTestMountpoint, err)
+	}
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	defaultCreateHelper(driver, t)
+	defer defaultCleanupHelper(driver, t)
+
+	file := defaultTestMountpoint + "/current/file"
+	ioutil.WriteFile(file, []byte("before"), 0644)
+	if err := driver.createSnap(defaultTestName, "snap", SnapshotMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(file, []byte("after"), 0644)
+
+	if err := driver.restoreSnap(defaultTestName, "snap", false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if content, _ := ioutil.ReadFile(file); string(content) != "before" {
+		t.Errorf("Expected content of snapshot, got %q", content)
+	}
+
+	snaps, _ := driver.listSnapshots(defaultTestName)
+	if len(snaps) != 2 || !strings.HasPrefix(snaps[0], preRestoreSnapPrefix) {
+		t.Fatalf("Expected pre-restore snapshot, got %v", snaps)
+	}
+	backup, _ := driver.getSnapshotPath(defaultTestMountpoint, snaps[0])
+	if content, _ := ioutil.ReadFile(backup + "/file"); string(content) != "after" {
+		t.Errorf("Expected previous content in pre-restore snapshot, got %q", content)
+	}
+	if info, err := driver.backend.ShowSubvolume(backup); err != nil || !info.ReadOnly {
+		t.Errorf("Expected read-only pre-restore snapshot, got %+v (%v)", info, err)
+	}
+	if infos, _ := driver.snapshotInfos(defaultTestName); len(infos) != 2 || infos[0].Creator != creatorPreRestore {
+		t.Errorf("Expected pre-restore snapshot to be recorded as such, got %+v", infos)
+	}
+	assertNoRestoreLeftovers(t)
+}
+
+func TestRestoreSnapshot_noBackup(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	defaultCreateHelper(driver, t)
+	defer defaultCleanupHelper(driver, t)
+
+	if err := driver.createSnap(defaultTestName, "snap", SnapshotMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.restoreSnap(defaultTestName, "snap", false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if snaps, _ := driver.listSnapshots(defaultTestName); len(snaps) != 1 || snaps[0] != "snap" {
+		t.Errorf("Expected no pre-restore snapshot, got %v", snaps)
+	}
+	assertNoRestoreLeftovers(t)
+}
+
+func TestRestoreSnapshot_refusedWhileMounted(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	defaultCreateHelper(driver, t)
+	defer defaultCleanupHelper(driver, t)
+
+	file := defaultTestMountpoint + "/current/file"
+	ioutil.WriteFile(file, []byte("before"), 0644)
+	if err := driver.createSnap(defaultTestName, "snap", SnapshotMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(file, []byte("after"), 0644)
+
+	driver.Mount(volume.MountRequest{Name: defaultTestName, ID: "container1"})
+	if err := driver.restoreSnap(defaultTestName, "snap", false, false); err == nil {
+		t.Fatal("Should not restore a mounted volume")
+	}
+	if content, _ := ioutil.ReadFile(file); string(content) != "after" {
+		t.Errorf("Expected unchanged content, got %q", content)
+	}
+	if snaps, _ := driver.listSnapshots(defaultTestName); len(snaps) != 1 {
+		t.Errorf("Expected no pre-restore snapshot, got %v", snaps)
+	}
+
+	if err := driver.restoreSnap(defaultTestName, "snap", true, false); err != nil {
+		t.Fatal("Should restore a mounted volume with force:", err)
+	}
+	if content, _ := ioutil.ReadFile(file); string(content) != "before" {
+		t.Errorf("Expected content of snapshot, got %q", content)
+	}
+	driver.Unmount(volume.UnmountRequest{Name: defaultTestName, ID: "container1"})
+}
+
+func TestRestoreSnapshot_failureKeepsCurrent(t *testing.T) {
+	failures := []struct {
+		name     string
+		fail     func(op string, p string) bool
+		exchange bool
+	}{
+		{name: "copy", fail: func(op string, p string) bool { return op == "snapshot" && strings.HasSuffix(p, "/.restore-new") }},
+		{name: "size limit", fail: func(op string, p string) bool { return op == "limit" && strings.HasSuffix(p, "/.restore-new") }},
+		{name: "backup", fail: func(op string, p string) bool { return op == "snapshot" && strings.Contains(p, preRestoreSnapPrefix) }},
+		{name: "exchange", exchange: true},
+	}
+
+	exchange := exchangeSubvolumes
+	defer func() { exchangeSubvolumes = exchange }()
+
+	for _, failure := range failures {
+		driver, cleanup := newTestDriver(t)
+		backend := failingBackend{Backend: driver.backend, fail: failure.fail}
+		driver.backend = backend
+		exchangeSubvolumes = exchange
+		if failure.exchange {
+			exchangeSubvolumes = func(a string, b string) error { return errors.New("injected failure") }
+		}
+
+		createHelper(driver, t, defaultTestName, defaultTestMountpoint)
+		driver.sizes[defaultTestName] = 1024 * 1024
+
+		file := defaultTestMountpoint + "/current/file"
+		ioutil.WriteFile(file, []byte("before"), 0644)
+		driver.createSnap(defaultTestName, "snap", SnapshotMeta{})
+		ioutil.WriteFile(file, []byte("after"), 0644)
+
+		if err := driver.restoreSnap(defaultTestName, "snap", false, false); err == nil {
+			t.Errorf("%v: Expected restore to fail", failure.name)
+		}
+
+		if content, _ := ioutil.ReadFile(file); string(content) != "after" {
+			t.Errorf("%v: Expected current state to be kept, got %q", failure.name, content)
+		}
+		if snaps, _ := driver.listSnapshots(defaultTestName); len(snaps) != 1 {
+			t.Errorf("%v: Expected no pre-restore snapshot, got %v", failure.name, snaps)
+		}
+		assertNoRestoreLeftovers(t)
+
+		exchangeSubvolumes = exchange
+		defaultCleanupHelper(driver, t)
+		cleanup()
+	}
+}
+
+func TestRestoreSnapshot_cleansUpInterruptedRestore(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	defaultCreateHelper(driver, t)
+	defer defaultCleanupHelper(driver, t)
+
+	file := defaultTestMountpoint + "/current/file"
+	ioutil.WriteFile(file, []byte("before"), 0644)
+	driver.createSnap(defaultTestName, "snap", SnapshotMeta{})
+	ioutil.WriteFile(file, []byte("after"), 0644)
+
+	// a copy left by a restore that crashed before the swap
+	if err := driver.backend.SnapshotSubvolume(defaultTestMountpoint+"/snaps/snap", defaultTestMountpoint+"/.restore-new", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.restoreSnap(defaultTestName, "snap", false, true); err != nil {
+		t.Fatal("Expected restore to remove the leftover copy:", err)
+	}
+	if content, _ := ioutil.ReadFile(file); string(content) != "before" {
+		t.Errorf("Expected content of snapshot, got %q", content)
+	}
+	assertNoRestoreLeftovers(t)
+
+	// current renamed away by a restore of an earlier version
+	if err := os.Rename(defaultTestMountpoint+"/current", defaultTestMountpoint+"/.restore-old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.cleanupRestore(defaultTestMountpoint); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(file); string(content) != "before" {
+		t.Errorf("Expected current to be moved back, got %q", content)
+	}
+	assertNoRestoreLeftovers(t)
+}
+
+func TestExportImportSnapshot(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	defaultCreateHelper(driver, t)
+	defer defaultCleanupHelper(driver, t)
+
+	ioutil.WriteFile(defaultTestMountpoint+"/current/file", []byte("content"), 0644)
+	if err := driver.createSnap(defaultTestName, "snap", SnapshotMeta{}); err != nil {
+		t.Fatal(err)
+	}
+
+	file := path.Join(driver.config.StateDir, "snap.btrfs")
+	if err := driver.exportSnap(defaultTestName, "snap", file, true); err != nil {
+		t.Fatal(err)
+	}
+
+	imported := defaultTestName + "-imported"
+	mountpoint := defaultTestMountpoint + "-imported"
+	if err := driver.importVolume(imported, mountpoint, file); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupHelper(driver, t, imported, mountpoint)
+
+	if content, _ := ioutil.ReadFile(mountpoint + "/current/file"); string(content) != "content" {
+		t.Errorf("Expected exported content, got %q", content)
+	}
+	if snaps, _ := driver.listSnapshots(imported); len(snaps) != 1 || snaps[0] != "snap" {
+		t.Errorf("Expected imported snapshot, got %v", snaps)
+	}
+}
+
+func TestImportVolume_checksNameFirst(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	defaultCreateHelper(driver, t)
+	defer defaultCleanupHelper(driver, t)
+
+	driver.createSnap(defaultTestName, "snap", SnapshotMeta{})
+	file := path.Join(driver.config.StateDir, "snap.btrfs")
+	if err := driver.exportSnap(defaultTestName, "snap", file, false); err != nil {
+		t.Fatal(err)
+	}
+
+	mountpoint := defaultTestMountpoint + "-imported"
+	for _, name := range []string{defaultTestName + "@snap", defaultTestName} {
+		if err := driver.importVolume(name, mountpoint, file); err == nil {
+			t.Errorf("Expected import as %q to fail", name)
+		}
+		if _, err := os.Stat(mountpoint); !os.IsNotExist(err) {
+			t.Errorf("Expected nothing to be received for %q, got %v", name, err)
+		}
+	}
+}
+
+func TestImportVolume_failureRollsBack(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	defaultCreateHelper(driver, t)
+	defer defaultCleanupHelper(driver, t)
+
+	driver.createSnap(defaultTestName, "snap", SnapshotMeta{})
+	file := path.Join(driver.config.StateDir, "snap.btrfs")
+	if err := driver.exportSnap(defaultTestName, "snap", file, false); err != nil {
+		t.Fatal(err)
+	}
+
+	imported := defaultTestName + "-imported"
+	mountpoint := defaultTestMountpoint + "-imported"
+	backend := driver.backend
+	driver.backend = failingBackend{Backend: backend, fail: func(op string, p string) bool {
+		return op == "snapshot" && p == mountpoint+"/current"
+	}}
+	if err := driver.importVolume(imported, mountpoint, file); err == nil {
+		t.Fatal("Expected import to fail")
+	}
+	if _, err := os.Stat(mountpoint); !os.IsNotExist(err) {
+		t.Errorf("Expected %v to be removed, got %v", mountpoint, err)
+	}
+
+	driver.backend = backend
+	if err := driver.importVolume(imported, mountpoint, file); err != nil {
+		t.Fatal("Expected retried import to succeed:", err)
+	}
+	cleanupHelper(driver, t, imported, mountpoint)
+}
+
+func TestSendSnapshot_usesReceivedSnapshotAsParent(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	defaultCreateHelper(driver, t)
+	defer defaultCleanupHelper(driver, t)
+
+	targetDir := path.Join(driver.config.StateDir, "backup")
+	os.Mkdir(targetDir, 0700)
+
+	driver.createSnap(defaultTestName, "snap1", SnapshotMeta{})
+	if err := driver.sendSnap(defaultTestName, "snap1", targetDir); err != nil {
+		t.Fatal(err)
+	}
+
+	driver.createSnap(defaultTestName, "snap2", SnapshotMeta{})
+	parent, err := driver.findCommonParent(defaultTestName, "snap2", targetDir)
+	if err != nil || parent != defaultTestMountpoint+"/snaps/snap1" {
+		t.Errorf("Expected snap1 as parent, got %q (%v)", parent, err)
+	}
+	if err := driver.sendSnap(defaultTestName, "snap2", targetDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(targetDir, "snap2")); err != nil {
+		t.Error("Expected snap2 in target directory:", err)
+	}
+}
+
+// newTestDriver keeps its state in a temporary directory, so tests don't
+// interfere with the state of a running daemon, and uses the fake backend, so
+// tests run without root and btrfs.
+func newTestDriver(t *testing.T) (LocalBtrfsDriver, func()) {
+	dir, err := ioutil.TempDir("", "local-btrfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultConfig()
+	config.StateDir = dir
+	config.Backend = backendFake
+	return NewLocalBtrfsDriver(config), func() { os.RemoveAll(dir) }
 }
 
 func createHelper(driver LocalBtrfsDriver, t *testing.T, name string, mountpoint string) {
@@ -111,10 +510,14 @@ func defaultCreateHelper(driver LocalBtrfsDriver, t *testing.T) {
 }
 
 func cleanupHelper(driver LocalBtrfsDriver, t *testing.T, name string, mountpoint string) {
-	if _, err := os.Stat(defaultTestMountpoint); !os.IsNotExist(err) {
-		cmd := exec.Command("../scripts/test-cleanup.sh", defaultTestMountpoint)
-		if output, err := cmd.CombinedOutput(); err != nil {
-			t.Error("[Cleanup] Error removing all subvolumes from test directory", err.Error(), "\n", string(output))
+	subvolumes, err := driver.backend.ListSubvolumes(mountpoint)
+	if err != nil {
+		t.Error("[Cleanup] Error listing subvolumes in test directory", err.Error())
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(subvolumes)))
+	for _, subvolume := range subvolumes {
+		if err := driver.backend.DeleteSubvolume(subvolume); err != nil {
+			t.Error("[Cleanup] Error removing subvolume from test directory", err.Error())
 		}
 	}
 
@@ -136,6 +539,42 @@ func cleanupHelper(driver LocalBtrfsDriver, t *testing.T, name string, mountpoin
 	}
 }
 
+func assertNoRestoreLeftovers(t *testing.T) {
+	for _, name := range []string{".restore-new", ".restore-old"} {
+		if _, err := os.Stat(path.Join(defaultTestMountpoint, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %v to be removed", name)
+		}
+	}
+}
+
+// failingBackend fails the operations for which fail returns true, to test
+// that the driver cleans up after errors.
+type failingBackend struct {
+	Backend
+	fail func(op string, path string) bool
+}
+
+func (backend failingBackend) SnapshotSubvolume(src string, dst string, readOnly bool) error {
+	if backend.fail != nil && backend.fail("snapshot", dst) {
+		return errors.New("injected failure")
+	}
+	return backend.Backend.SnapshotSubvolume(src, dst, readOnly)
+}
+
+func (backend failingBackend) DeleteSubvolume(p string) error {
+	if backend.fail != nil && backend.fail("delete", p) {
+		return errors.New("injected failure")
+	}
+	return backend.Backend.DeleteSubvolume(p)
+}
+
+func (backend failingBackend) LimitSubvolume(p string, size uint64) error {
+	if backend.fail != nil && backend.fail("limit", p) {
+		return errors.New("injected failure")
+	}
+	return backend.Backend.LimitSubvolume(p, size)
+}
+
 func defaultCleanupHelper(driver LocalBtrfsDriver, t *testing.T) {
 	cleanupHelper(driver, t, defaultTestName, defaultTestMountpoint)
 }
@@ -0,0 +1,224 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// createGroupSnap takes snapshots of all volumes under one name, recorded as
+// a group. The pre-snapshot hooks of all volumes run before the first
+// snapshot and the post-snapshot hooks after the last, so the snapshots are
+// consistent with each other if the hooks quiesce the application. If any
+// snapshot fails, the snapshots already taken are removed.
+func (driver LocalBtrfsDriver) createGroupSnap(group string, volumeNames []string, snapshotName string, meta SnapshotMeta) (err error) {
+	defer logOperation("create-group-snapshot", Fields{"group": group, "volumes": volumeNames, "snapshot": snapshotName}, time.Now(), &err)
+
+	if group == "" {
+		return errors.New("group name must not be empty")
+	}
+	if len(volumeNames) == 0 {
+		return errors.New(fmt.Sprintf("group %q has no volumes", group))
+	}
+
+	// check all volumes first, so nothing is taken if one can't be
+	volumePaths := map[string]string{}
+	for _, volumeName := range volumeNames {
+		if _, seen := volumePaths[volumeName]; seen {
+			return errors.New(fmt.Sprintf("volume %q is given more than once", volumeName))
+		}
+
+		volumePath, err := driver.getVolumePath(volumeName)
+		if err != nil {
+			return err
+		}
+		volumePaths[volumeName] = volumePath
+		snapPath, err := driver.getSnapshotPath(volumePath, snapshotName)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(snapPath); !os.IsNotExist(err) {
+			return errors.New(fmt.Sprintf("snapshot %q already exists for volume %q (%v)", snapshotName, volumeName, snapPath))
+		}
+	}
+
+	meta.Group = group
+	meta.Members = volumeNames
+	if meta.Created.IsZero() {
+		meta.Created = time.Now()
+	}
+
+	// the post-snapshot hooks of all volumes whose pre-snapshot hook ran
+	var postHooks []func() error
+	defer func() {
+		for i := len(postHooks) - 1; i >= 0; i-- {
+			if hookErr := postHooks[i](); hookErr != nil && err == nil {
+				err = errors.New(fmt.Sprintf("group snapshot %q was taken, but %v", snapshotName, hookErr))
+			}
+		}
+	}()
+	for _, volumeName := range volumeNames {
+		hooks := driver.snapshotHooks(volumeName)
+		env := driver.hookEnv(volumeName, snapshotName, volumePaths[volumeName]+"/current")
+		postHooks = append(postHooks, func() error { return driver.runSnapshotHook(hooks, hookPostSnapshot, env) })
+		if err := driver.runSnapshotHook(hooks, hookPreSnapshot, env); err != nil {
+			return err
+		}
+	}
+
+	var taken []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, snapPath := range taken {
+			if rollbackErr := driver.backend.DeleteSubvolume(snapPath); rollbackErr != nil {
+				logger.With(Fields{"group": group, "path": snapPath}).WithError(rollbackErr).Error("could not roll back group snapshot")
+			}
+		}
+	}()
+	for _, volumeName := range volumeNames {
+		volumePath := volumePaths[volumeName]
+		snapPath, err := driver.getSnapshotPath(volumePath, snapshotName)
+		if err != nil {
+			return err
+		}
+		if err := driver.backend.SnapshotSubvolume(volumePath+"/current", snapPath, true); err != nil {
+			return err
+		}
+		taken = append(taken, snapPath)
+	}
+
+	for _, volumeName := range volumeNames {
+		driver.recordSnapshot(volumePaths[volumeName], snapshotName, meta)
+	}
+	return nil
+}
+
+// groupMembers returns the volumes of the group snapshot. It fails if any
+// member lost its snapshot, as the rest of the set alone is inconsistent.
+func (driver LocalBtrfsDriver) groupMembers(group string, snapshotName string) ([]string, error) {
+	var members []string
+	found := map[string]bool{}
+	for _, volumeName := range driver.volumeNames() {
+		volumePath, err := driver.getVolumePath(volumeName)
+		if err != nil {
+			continue
+		}
+		meta, err := readSnapshotMeta(volumePath)
+		if err != nil {
+			logger.With(Fields{"volume": volumeName}).WithError(err).Warn("could not read snapshot metadata")
+			continue
+		}
+		if m, ok := meta[snapshotName]; ok && m.Group == group {
+			found[volumeName] = true
+			members = m.Members
+		}
+	}
+
+	if len(found) == 0 {
+		return nil, errors.New(fmt.Sprintf("no snapshot %q of group %q found", snapshotName, group))
+	}
+	for _, volumeName := range members {
+		if !found[volumeName] {
+			return nil, errors.New(fmt.Sprintf("snapshot %q of group %q is missing for volume %q", snapshotName, group, volumeName))
+		}
+	}
+
+	sorted := append([]string{}, members...)
+	sort.Strings(sorted)
+	return sorted, nil
+}
+
+// restoreGroupSnap restores the snapshots of all volumes of the group
+// snapshot. The previous states are kept as pre-restore group snapshot, which
+// is also used to roll back the volumes already restored if one fails. With
+// noBackup it is removed after all volumes are restored.
+func (driver LocalBtrfsDriver) restoreGroupSnap(group string, snapshotName string, force bool, noBackup bool) (err error) {
+	defer logOperation("restore-group-snapshot", Fields{"group": group, "snapshot": snapshotName}, time.Now(), &err)
+
+	members, err := driver.groupMembers(group, snapshotName)
+	if err != nil {
+		return err
+	}
+
+	// checked again by each restore, this fails before anything is changed
+	driver.mutex.RLock()
+	for _, volumeName := range members {
+		if err := driver.checkNotMounted(volumeName, force); err != nil {
+			driver.mutex.RUnlock()
+			return err
+		}
+	}
+	driver.mutex.RUnlock()
+	backupName, err := driver.unusedSnapName(members, preRestoreSnapName(time.Now()))
+	if err != nil {
+		return err
+	}
+
+	var restored []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(restored) - 1; i >= 0; i-- {
+			volumeName := restored[i]
+			if rollbackErr := driver.restoreSnapshot(volumeName, backupName, true, "", SnapshotMeta{}); rollbackErr != nil {
+				logger.With(Fields{"group": group, "volume": volumeName}).WithError(rollbackErr).Error("could not roll back group restore")
+				continue
+			}
+			driver.removeSnap(volumeName, backupName)
+		}
+	}()
+
+	backupMeta := SnapshotMeta{
+		Created:     time.Now(),
+		Description: fmt.Sprintf("before restoring group snapshot %v", snapshotName),
+		Creator:     creatorPreRestore,
+		Group:       group,
+		Members:     members,
+	}
+	for _, volumeName := range members {
+		if err := driver.restoreSnapshot(volumeName, snapshotName, force, backupName, backupMeta); err != nil {
+			return errors.New(fmt.Sprintf("could not restore volume %q: %v", volumeName, err))
+		}
+		restored = append(restored, volumeName)
+	}
+
+	if noBackup {
+		for _, volumeName := range members {
+			if err := driver.removeSnap(volumeName, backupName); err != nil {
+				logger.With(Fields{"volume": volumeName, "snapshot": backupName}).WithError(err).Warn("could not remove pre-restore snapshot")
+			}
+		}
+	}
+	return nil
+}
+
+// unusedSnapName returns name, or name with a number appended if any of the
+// volumes has a snapshot of that name, e.g. after restores within a second.
+func (driver LocalBtrfsDriver) unusedSnapName(volumeNames []string, name string) (string, error) {
+	candidate := name
+	for i := 1; ; i++ {
+		used := false
+		for _, volumeName := range volumeNames {
+			volumePath, err := driver.getVolumePath(volumeName)
+			if err != nil {
+				return "", err
+			}
+			snapPath, err := driver.getSnapshotPath(volumePath, candidate)
+			if err != nil {
+				return "", err
+			}
+			if _, err := os.Stat(snapPath); !os.IsNotExist(err) {
+				used = true
+			}
+		}
+		if !used {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s-%d", name, i)
+	}
+}
@@ -0,0 +1,132 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var groupTestVolumes = []string{"db", "uploads", "search"}
+
+// createGroupHelper creates the group test volumes in the state directory,
+// each with a file containing content.
+func createGroupHelper(driver LocalBtrfsDriver, t *testing.T, content string) {
+	for _, name := range groupTestVolumes {
+		createHelper(driver, t, name, path.Join(driver.config.StateDir, name))
+	}
+	writeGroupFiles(driver, t, content)
+}
+
+func writeGroupFiles(driver LocalBtrfsDriver, t *testing.T, content string) {
+	for _, volumePath := range driver.volumes {
+		if err := ioutil.WriteFile(volumePath+"/current/file", []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func assertGroupFiles(driver LocalBtrfsDriver, t *testing.T, expected string) {
+	for _, name := range groupTestVolumes {
+		if content, _ := ioutil.ReadFile(driver.volumes[name] + "/current/file"); string(content) != expected {
+			t.Errorf("Expected %q in volume %v, got %q", expected, name, content)
+		}
+	}
+}
+
+func TestGroupSnapshot(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	createGroupHelper(driver, t, "before")
+	if err := driver.createGroupSnap("app", groupTestVolumes, "nightly", SnapshotMeta{Description: "nightly"}); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, _ := driver.snapshotInfos("uploads")
+	if len(infos) != 1 || infos[0].Group != "app" || infos[0].Description != "nightly" {
+		t.Errorf("Unexpected group snapshot %+v", infos)
+	}
+	members, err := driver.groupMembers("app", "nightly")
+	if expected := []string{"db", "search", "uploads"}; err != nil || !reflect.DeepEqual(members, expected) {
+		t.Errorf("Expected members %v, got %v (%v)", expected, members, err)
+	}
+
+	if err := driver.createGroupSnap("app", groupTestVolumes, "nightly", SnapshotMeta{}); err == nil {
+		t.Error("Expected error for existing snapshot")
+	}
+	if err := driver.createGroupSnap("app", []string{"db", "db"}, "other", SnapshotMeta{}); err == nil {
+		t.Error("Expected error for duplicate volume")
+	}
+
+	writeGroupFiles(driver, t, "after")
+	if err := driver.restoreGroupSnap("app", "nightly", false, false); err != nil {
+		t.Fatal(err)
+	}
+	assertGroupFiles(driver, t, "before")
+
+	// the previous states are a group snapshot, too
+	snaps, _ := driver.listSnapshots("db")
+	if len(snaps) != 2 || !strings.HasPrefix(snaps[1], preRestoreSnapPrefix) {
+		t.Fatalf("Expected a pre-restore snapshot, got %v", snaps)
+	}
+	if err := driver.restoreGroupSnap("app", snaps[1], false, true); err != nil {
+		t.Fatal(err)
+	}
+	assertGroupFiles(driver, t, "after")
+
+	if _, err := driver.groupMembers("other", "nightly"); err == nil {
+		t.Error("Expected error for unknown group")
+	}
+	driver.removeSnap("search", "nightly")
+	if err := driver.restoreGroupSnap("app", "nightly", false, false); err == nil {
+		t.Error("Expected error for incomplete group snapshot")
+	}
+	assertGroupFiles(driver, t, "after")
+}
+
+func TestGroupSnapshot_failureRollsBack(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	createGroupHelper(driver, t, "before")
+	driver.backend = failingBackend{Backend: driver.backend, fail: func(op string, p string) bool {
+		return op == "snapshot" && strings.HasSuffix(p, "/search/snaps/nightly")
+	}}
+
+	if err := driver.createGroupSnap("app", groupTestVolumes, "nightly", SnapshotMeta{}); err == nil {
+		t.Fatal("Expected group snapshot to fail")
+	}
+	for _, name := range groupTestVolumes {
+		if snaps, _ := driver.listSnapshots(name); len(snaps) != 0 {
+			t.Errorf("Expected no snapshots of %v after rollback, got %v", name, snaps)
+		}
+	}
+}
+
+func TestRestoreGroupSnapshot_failureRollsBack(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	createGroupHelper(driver, t, "before")
+	if err := driver.createGroupSnap("app", groupTestVolumes, "nightly", SnapshotMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	writeGroupFiles(driver, t, "after")
+
+	// members are restored in order, so db and search are rolled back
+	driver.backend = failingBackend{Backend: driver.backend, fail: func(op string, p string) bool {
+		return op == "snapshot" && strings.HasSuffix(p, "/uploads/.restore-new")
+	}}
+	if err := driver.restoreGroupSnap("app", "nightly", false, false); err == nil {
+		t.Fatal("Expected group restore to fail")
+	}
+	assertGroupFiles(driver, t, "after")
+
+	for _, name := range groupTestVolumes {
+		if snaps, _ := driver.listSnapshots(name); len(snaps) != 1 {
+			t.Errorf("Expected only the group snapshot of %v, got %v", name, snaps)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package daemon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	hookPreSnapshot  = "pre-snapshot"
+	hookPostSnapshot = "post-snapshot"
+
+	defaultHookTimeout = time.Minute
+)
+
+// SnapshotHooks name the commands run around the snapshots of a volume, e.g.
+// to flush and freeze a database for an application-consistent snapshot.
+// The commands are defined in the config only, as anyone able to create
+// volumes could run anything as root otherwise. They get the volume,
+// snapshot and path of the current state in the LOCAL_BTRFS_VOLUME,
+// LOCAL_BTRFS_SNAPSHOT and LOCAL_BTRFS_PATH environment variables, and the
+// number and IDs of the mounts of the volume in LOCAL_BTRFS_MOUNTS and
+// LOCAL_BTRFS_MOUNT_IDS. Docker generates the mount IDs, they aren't the IDs
+// of the containers using the volume.
+type SnapshotHooks struct {
+	PreSnapshot  string        `json:"preSnapshot,omitempty"`
+	PostSnapshot string        `json:"postSnapshot,omitempty"`
+	Timeout      time.Duration `json:"timeout,omitempty"`
+}
+
+// parseHooks reads the hooks from the driver options of a volume. It returns
+// nil if no hook option is given.
+func parseHooks(options map[string]string) (*SnapshotHooks, error) {
+	hooks := SnapshotHooks{
+		PreSnapshot:  options["pre_snapshot_hook"],
+		PostSnapshot: options["post_snapshot_hook"],
+	}
+
+	if value, ok := options["hook_timeout"]; ok {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return nil, errors.New(fmt.Sprintf("invalid hook_timeout %q", value))
+		}
+		hooks.Timeout = timeout
+	}
+
+	if hooks == (SnapshotHooks{}) {
+		return nil, nil
+	}
+	return &hooks, nil
+}
+
+// snapshotHooks returns the hooks of the volume, or the default hooks for
+// volumes created without hook options.
+func (driver LocalBtrfsDriver) snapshotHooks(volumeName string) SnapshotHooks {
+	driver.mutex.RLock()
+	defer driver.mutex.RUnlock()
+
+	if hooks, ok := driver.hooks[volumeName]; ok {
+		return *hooks
+	}
+	if driver.defaultHooks != nil {
+		return *driver.defaultHooks
+	}
+	return SnapshotHooks{}
+}
+
+// checkHooks returns an error if a hook names no command of the config.
+func (defaults HookDefaults) checkHooks(hooks *SnapshotHooks) error {
+	if hooks == nil {
+		return nil
+	}
+	for _, name := range []string{hooks.PreSnapshot, hooks.PostSnapshot} {
+		if _, ok := defaults.Commands[name]; name != "" && !ok {
+			return errors.New(fmt.Sprintf("unknown hook %q, hooks are defined in the [hooks.commands] section of the config", name))
+		}
+	}
+	return nil
+}
+
+func (driver LocalBtrfsDriver) hookEnv(volumeName string, snapshotName string, currentPath string) map[string]string {
+	driver.mutex.RLock()
+	ids := driver.mounts[volumeName]
+	driver.mutex.RUnlock()
+
+	return map[string]string{
+		"volume":    volumeName,
+		"snapshot":  snapshotName,
+		"path":      currentPath,
+		"mounts":    strconv.Itoa(len(ids)),
+		"mount_ids": strings.Join(ids, " "),
+	}
+}
+
+// runSnapshotHook runs the command the hook of the volume names, if any.
+func (driver LocalBtrfsDriver) runSnapshotHook(hooks SnapshotHooks, hook string, env map[string]string) error {
+	name := hooks.PreSnapshot
+	if hook == hookPostSnapshot {
+		name = hooks.PostSnapshot
+	}
+	if name == "" {
+		return nil
+	}
+
+	command, ok := driver.config.Hooks.Commands[name]
+	if !ok {
+		return errors.New(fmt.Sprintf("%s hook failed: unknown hook %q", hook, name))
+	}
+	return hooks.runHook(hook, command, env)
+}
+
+// runHook runs the command of a hook with sh. Commands that don't finish
+// within the timeout are killed and fail.
+func (hooks SnapshotHooks) runHook(hook string, command string, env map[string]string) (err error) {
+	if command == "" {
+		return nil
+	}
+	fields := Fields{"hook": hook, "command": command}
+	for name, value := range env {
+		fields[name] = value
+	}
+	defer logOperation("run-hook", fields, time.Now(), &err)
+
+	timeout := hooks.Timeout
+	if timeout == 0 {
+		timeout = defaultHookTimeout
+	}
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), "LOCAL_BTRFS_HOOK="+hook)
+	for name, value := range env {
+		cmd.Env = append(cmd.Env, "LOCAL_BTRFS_"+strings.ToUpper(name)+"="+value)
+	}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// the whole process group is killed, children of sh would keep the
+	// output open otherwise
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return errors.New(fmt.Sprintf("%s hook failed: %v", hook, err))
+	}
+	timer := time.AfterFunc(timeout, func() { syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) })
+	err = cmd.Wait()
+	if !timer.Stop() {
+		return errors.New(fmt.Sprintf("%s hook timed out after %v", hook, timeout))
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s hook failed: %v: %s", hook, err, strings.TrimSpace(output.String())))
+	}
+	return nil
+}
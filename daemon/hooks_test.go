@@ -0,0 +1,115 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestParseHooks(t *testing.T) {
+	hooks, err := parseHooks(map[string]string{"size": "1G"})
+	if err != nil || hooks != nil {
+		t.Errorf("Expected no hooks, got %+v (%v)", hooks, err)
+	}
+
+	hooks, err = parseHooks(map[string]string{"pre_snapshot_hook": "sync", "hook_timeout": "10s"})
+	if err != nil || hooks == nil || hooks.PreSnapshot != "sync" || hooks.PostSnapshot != "" || hooks.Timeout != 10*time.Second {
+		t.Errorf("Unexpected hooks %+v (%v)", hooks, err)
+	}
+
+	if _, err := parseHooks(map[string]string{"hook_timeout": "-1s"}); err == nil {
+		t.Error("Expected error for invalid timeout")
+	}
+}
+
+func TestSnapshotHooks(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	log := path.Join(driver.config.StateDir, "hooks.log")
+	driver.config.Hooks.Commands = map[string]string{
+		"pre":  `echo "pre $LOCAL_BTRFS_VOLUME $LOCAL_BTRFS_SNAPSHOT $LOCAL_BTRFS_PATH $LOCAL_BTRFS_MOUNTS $LOCAL_BTRFS_MOUNT_IDS" >> ` + log + `; test "$LOCAL_BTRFS_SNAPSHOT" != fail`,
+		"post": `echo "post $LOCAL_BTRFS_SNAPSHOT" >> ` + log,
+	}
+
+	// commands can't be given as options, only hooks of the config
+	res := driver.Create(volume.Request{
+		Name: defaultTestName,
+		Options: map[string]string{
+			"mountpoint":        defaultTestMountpoint,
+			"pre_snapshot_hook": "touch /tmp/pwned",
+		},
+	})
+	if res.Err == "" || !strings.Contains(res.Err, "unknown hook") {
+		t.Fatalf("Expected error for unknown hook, got %+v", res)
+	}
+
+	res = driver.Create(volume.Request{
+		Name: defaultTestName,
+		Options: map[string]string{
+			"mountpoint":         defaultTestMountpoint,
+			"pre_snapshot_hook":  "pre",
+			"post_snapshot_hook": "post",
+		},
+	})
+	if res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	defer defaultCleanupHelper(driver, t)
+	driver.Mount(volume.MountRequest{Name: defaultTestName, ID: "container1"})
+	defer driver.Unmount(volume.UnmountRequest{Name: defaultTestName, ID: "container1"})
+
+	if err := driver.createSnap(defaultTestName, "snap", SnapshotMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.createSnap(defaultTestName, "fail", SnapshotMeta{}); err == nil {
+		t.Error("Expected error for failing pre-snapshot hook")
+	}
+	if _, err := os.Stat(defaultTestMountpoint + "/snaps/fail"); !os.IsNotExist(err) {
+		t.Error("Failing pre-snapshot hook should abort the snapshot")
+	}
+
+	content, _ := ioutil.ReadFile(log)
+	expected := []string{
+		"pre " + defaultTestName + " snap " + defaultTestMountpoint + "/current 1 container1",
+		"post snap",
+		"pre " + defaultTestName + " fail " + defaultTestMountpoint + "/current 1 container1",
+		"post fail",
+	}
+	if actual := strings.Split(strings.TrimSpace(string(content)), "\n"); strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected hook calls\n%v\ngot\n%v", expected, actual)
+	}
+}
+
+func TestSnapshotHooks_postHookFailure(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	driver.config.Hooks.Commands = map[string]string{"fail": "exit 1"}
+	driver.defaultHooks = &SnapshotHooks{PostSnapshot: "fail"}
+	defaultCreateHelper(driver, t)
+	defer defaultCleanupHelper(driver, t)
+
+	if err := driver.createSnap(defaultTestName, "snap", SnapshotMeta{}); err == nil {
+		t.Error("Expected error for failing post-snapshot hook")
+	}
+	if _, err := driver.existingSnapshotPath(defaultTestName, "snap"); err != nil {
+		t.Error("Snapshot should be kept if the post-snapshot hook fails:", err)
+	}
+}
+
+func TestRunHook_timeout(t *testing.T) {
+	hooks := SnapshotHooks{Timeout: 50 * time.Millisecond}
+	start := time.Now()
+	if err := hooks.runHook(hookPreSnapshot, "sleep 5", nil); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Expected timeout, got %v", err)
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Error("Hook should be killed on timeout")
+	}
+}
@@ -0,0 +1,193 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var (
+	logLevels  = []string{"debug", "info", "warn", "error"}
+	logFormats = []string{"text", "json"}
+)
+
+// Fields are the structured data of a log message, e.g. the volume or the
+// operation it belongs to.
+type Fields map[string]interface{}
+
+// Logger writes leveled messages with fields, either as logfmt style text or
+// as one JSON object per line.
+type Logger struct {
+	out    io.Writer
+	mutex  *sync.Mutex
+	level  int
+	json   bool
+	fields Fields
+	now    func() time.Time
+}
+
+// logger is used by the whole daemon. It logs at info level as text until
+// SetupLogging is called.
+var logger, _ = NewLogger(os.Stdout, "info", "text")
+
+func NewLogger(out io.Writer, level string, format string) (*Logger, error) {
+	levelIndex := indexOf(logLevels, level)
+	if levelIndex < 0 {
+		return nil, errors.New(fmt.Sprintf("invalid log_level %q, must be one of %v", level, logLevels))
+	}
+	if indexOf(logFormats, format) < 0 {
+		return nil, errors.New(fmt.Sprintf("invalid log_format %q, must be one of %v", format, logFormats))
+	}
+
+	return &Logger{
+		out:    out,
+		mutex:  &sync.Mutex{},
+		level:  levelIndex,
+		json:   format == "json",
+		fields: Fields{},
+		now:    time.Now,
+	}, nil
+}
+
+// SetupLogging configures the logger of the daemon.
+func SetupLogging(config Config) error {
+	l, err := NewLogger(os.Stdout, config.LogLevel, config.LogFormat)
+	if err != nil {
+		return err
+	}
+	logger = l
+	return nil
+}
+
+// With returns a logger which adds the given fields to all messages.
+func (l *Logger) With(fields Fields) *Logger {
+	child := *l
+	child.fields = Fields{}
+	for k, v := range l.fields {
+		child.fields[k] = v
+	}
+	for k, v := range fields {
+		child.fields[k] = v
+	}
+	return &child
+}
+
+func (l *Logger) WithError(err error) *Logger {
+	return l.With(Fields{"error": err})
+}
+
+func (l *Logger) Debug(msg string) { l.log(levelDebug, msg) }
+func (l *Logger) Info(msg string)  { l.log(levelInfo, msg) }
+func (l *Logger) Warn(msg string)  { l.log(levelWarn, msg) }
+func (l *Logger) Error(msg string) { l.log(levelError, msg) }
+
+func (l *Logger) log(level int, msg string) {
+	if level < l.level {
+		return
+	}
+
+	var line string
+	if l.json {
+		line = l.formatJson(level, msg)
+	} else {
+		line = l.formatText(level, msg)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	io.WriteString(l.out, line+"\n")
+}
+
+func (l *Logger) formatText(level int, msg string) string {
+	parts := []string{
+		"time=" + l.now().Format(time.RFC3339),
+		"level=" + logLevels[level],
+		"msg=" + quoteLogValue(msg),
+	}
+	for _, key := range l.sortedKeys() {
+		parts = append(parts, key+"="+quoteLogValue(formatLogValue(l.fields[key])))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l *Logger) formatJson(level int, msg string) string {
+	entry := map[string]interface{}{}
+	for key, value := range l.fields {
+		entry[key] = value
+		switch v := value.(type) {
+		case error, time.Duration:
+			entry[key] = formatLogValue(v)
+		}
+	}
+	entry["time"] = l.now().Format(time.RFC3339)
+	entry["level"] = logLevels[level]
+	entry["msg"] = msg
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Sprintf(`{"level":"error","msg":%q}`, "could not encode log message: "+err.Error())
+	}
+	return string(data)
+}
+
+func (l *Logger) sortedKeys() []string {
+	var keys []string
+	for key := range l.fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatLogValue(value interface{}) string {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case []string:
+		return strings.Join(v, " ")
+	}
+	return fmt.Sprint(value)
+}
+
+func quoteLogValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// logOperation logs the outcome and duration of an operation. It is meant to
+// be deferred with a pointer to the named error result:
+//
+//	defer logOperation("create-snapshot", Fields{"volume": name}, time.Now(), &err)
+func logOperation(operation string, fields Fields, start time.Time, err *error) {
+	l := logger.With(fields).With(Fields{"operation": operation, "duration": time.Since(start)})
+	if *err != nil {
+		l.WithError(*err).Error("operation failed")
+		return
+	}
+	l.Info("operation succeeded")
+}
@@ -0,0 +1,74 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLogger(t *testing.T, level string, format string) (*Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	l, err := NewLogger(&buf, level, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.now = func() time.Time { return time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC) }
+	return l, &buf
+}
+
+func TestLogger_text(t *testing.T) {
+	l, buf := newTestLogger(t, "info", "text")
+
+	l.With(Fields{"volume": "data", "command": "btrfs subvolume delete /x"}).WithError(errors.New("exit status 1")).Error("btrfs call failed")
+
+	expected := `time=2017-03-01T12:00:00Z level=error msg="btrfs call failed" command="btrfs subvolume delete /x" error="exit status 1" volume=data` + "\n"
+	if buf.String() != expected {
+		t.Errorf("Expected\n%s got\n%s", expected, buf.String())
+	}
+}
+
+func TestLogger_json(t *testing.T) {
+	l, buf := newTestLogger(t, "info", "json")
+
+	l.With(Fields{"volume": "data", "duration": 1500 * time.Millisecond}).Info("operation succeeded")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["level"] != "info" || entry["msg"] != "operation succeeded" || entry["volume"] != "data" || entry["duration"] != "1.5s" {
+		t.Errorf("Unexpected entry %v", entry)
+	}
+}
+
+func TestLogger_level(t *testing.T) {
+	l, buf := newTestLogger(t, "warn", "text")
+
+	l.Debug("debug")
+	l.Info("info")
+	l.Warn("warn")
+	l.Error("error")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "msg=warn") || !strings.Contains(lines[1], "msg=error") {
+		t.Errorf("Expected only warn and error, got %v", lines)
+	}
+
+	if _, err := NewLogger(buf, "verbose", "text"); err == nil {
+		t.Error("Invalid level should fail")
+	}
+}
+
+func TestLogger_withDoesNotModifyParent(t *testing.T) {
+	l, buf := newTestLogger(t, "info", "text")
+
+	l.With(Fields{"volume": "data"})
+	l.Info("plain")
+
+	if strings.Contains(buf.String(), "volume") {
+		t.Errorf("Parent logger should not have child fields, got %s", buf.String())
+	}
+}
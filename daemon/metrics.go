@@ -0,0 +1,329 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+const (
+	metricsPrefix = "local_btrfs_"
+
+	// kinds of calls, used as prefix of their metrics
+	callPlugin = "plugin"
+	callRpc    = "rpc"
+)
+
+// latencyBuckets are the upper bounds of the latency histograms in seconds.
+// Snapshots and restores of large volumes take seconds, quota scans longer.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60}
+
+type callKey struct {
+	kind   string
+	method string
+}
+
+type callStats struct {
+	count   uint64
+	errors  uint64
+	sum     float64
+	buckets []uint64
+}
+
+// metricsRecorder counts the calls to the daemon and the failures of the
+// backend. Everything else is read from the volumes when scraped.
+type metricsRecorder struct {
+	mutex         *sync.Mutex
+	calls         map[callKey]*callStats
+	btrfsFailures map[string]uint64
+}
+
+var metrics = newMetricsRecorder()
+
+func newMetricsRecorder() metricsRecorder {
+	return metricsRecorder{
+		mutex:         &sync.Mutex{},
+		calls:         map[callKey]*callStats{},
+		btrfsFailures: map[string]uint64{},
+	}
+}
+
+func (m metricsRecorder) observeCall(kind string, method string, start time.Time, failed bool) {
+	seconds := time.Since(start).Seconds()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key := callKey{kind, method}
+	stats, ok := m.calls[key]
+	if !ok {
+		stats = &callStats{buckets: make([]uint64, len(latencyBuckets))}
+		m.calls[key] = stats
+	}
+	stats.count++
+	if failed {
+		stats.errors++
+	}
+	stats.sum += seconds
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			stats.buckets[i]++
+		}
+	}
+}
+
+func (m metricsRecorder) countBtrfsFailure(operation string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.btrfsFailures[operation]++
+}
+
+// observeRpc records an RPC call, like logOperation it is deferred with the
+// named error result of the method.
+func observeRpc(method string, start time.Time, err *error) {
+	metrics.observeCall(callRpc, method, start, *err != nil)
+}
+
+func (m metricsRecorder) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	keys := make([]callKey, 0, len(m.calls))
+	for key := range m.calls {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].kind != keys[j].kind {
+			return keys[i].kind < keys[j].kind
+		}
+		return keys[i].method < keys[j].method
+	})
+
+	for _, kind := range []string{callPlugin, callRpc} {
+		name := metricsPrefix + kind + "_requests"
+		writeHeader(w, name+"_total", "counter", fmt.Sprintf("Number of %s requests by method.", kind))
+		for _, key := range keys {
+			if key.kind == kind {
+				writeSample(w, name+"_total", metricLabels("method", key.method), float64(m.calls[key].count))
+			}
+		}
+		writeHeader(w, name+"_failed_total", "counter", fmt.Sprintf("Number of failed %s requests by method.", kind))
+		for _, key := range keys {
+			if key.kind == kind {
+				writeSample(w, name+"_failed_total", metricLabels("method", key.method), float64(m.calls[key].errors))
+			}
+		}
+
+		name = metricsPrefix + kind + "_request_duration_seconds"
+		writeHeader(w, name, "histogram", fmt.Sprintf("Latency of %s requests by method.", kind))
+		for _, key := range keys {
+			if key.kind != kind {
+				continue
+			}
+			stats := m.calls[key]
+			for i, bound := range latencyBuckets {
+				writeSample(w, name+"_bucket", metricLabels("method", key.method, "le", strconv.FormatFloat(bound, 'g', -1, 64)), float64(stats.buckets[i]))
+			}
+			writeSample(w, name+"_bucket", metricLabels("method", key.method, "le", "+Inf"), float64(stats.count))
+			writeSample(w, name+"_sum", metricLabels("method", key.method), stats.sum)
+			writeSample(w, name+"_count", metricLabels("method", key.method), float64(stats.count))
+		}
+	}
+
+	operations := make([]string, 0, len(m.btrfsFailures))
+	for operation := range m.btrfsFailures {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+	writeHeader(w, metricsPrefix+"btrfs_failures_total", "counter", "Number of failed btrfs operations, e.g. qgroup-usage fails without quotas.")
+	for _, operation := range operations {
+		writeSample(w, metricsPrefix+"btrfs_failures_total", metricLabels("operation", operation), float64(m.btrfsFailures[operation]))
+	}
+}
+
+// writeVolumeMetrics writes the gauges of the volumes and their snapshots.
+func (driver LocalBtrfsDriver) writeVolumeMetrics(w io.Writer, now time.Time) {
+	infos := driver.volumeInfos()
+
+	writeHeader(w, metricsPrefix+"volumes", "gauge", "Number of volumes.")
+	writeSample(w, metricsPrefix+"volumes", "", float64(len(infos)))
+
+	writeHeader(w, metricsPrefix+"snapshots", "gauge", "Number of snapshots by volume.")
+	for _, info := range infos {
+		writeSample(w, metricsPrefix+"snapshots", metricLabels("volume", info.Name), float64(info.Snapshots))
+	}
+
+	writeHeader(w, metricsPrefix+"volume_referenced_bytes", "gauge", "Referenced bytes of the current state by volume, requires quotas.")
+	for _, info := range infos {
+		if info.ReferencedBytes != nil {
+			writeSample(w, metricsPrefix+"volume_referenced_bytes", metricLabels("volume", info.Name), float64(*info.ReferencedBytes))
+		}
+	}
+	writeHeader(w, metricsPrefix+"volume_exclusive_bytes", "gauge", "Exclusive bytes of the current state by volume, requires quotas.")
+	for _, info := range infos {
+		if info.ExclusiveBytes != nil {
+			writeSample(w, metricsPrefix+"volume_exclusive_bytes", metricLabels("volume", info.Name), float64(*info.ExclusiveBytes))
+		}
+	}
+
+	writeHeader(w, metricsPrefix+"last_scheduled_snapshot_age_seconds", "gauge", "Time since the last scheduled snapshot by volume.")
+	for _, info := range infos {
+		names, err := driver.listSnapshots(info.Name)
+		if err != nil {
+			continue
+		}
+		if snaps := scheduledSnaps(names); len(snaps) > 0 {
+			writeSample(w, metricsPrefix+"last_scheduled_snapshot_age_seconds", metricLabels("volume", info.Name), now.Sub(snaps[0].time).Seconds())
+		}
+	}
+}
+
+// MetricsHandler serves the metrics in the Prometheus text format.
+func (driver LocalBtrfsDriver) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.write(w)
+		driver.writeVolumeMetrics(w, time.Now())
+	})
+}
+
+func writeHeader(w io.Writer, name string, metricType string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func writeSample(w io.Writer, name string, labels string, value float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// metricLabels formats the label pairs of a sample, e.g. {volume="data"}.
+func metricLabels(pairs ...string) string {
+	s := "{"
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			s += ","
+		}
+		s += pairs[i] + "=" + strconv.Quote(pairs[i+1])
+	}
+	return s + "}"
+}
+
+// instrumentedDriver records the calls of docker to the driver.
+type instrumentedDriver struct {
+	driver volume.Driver
+}
+
+// InstrumentDriver returns the driver with metrics of all plugin calls.
+func InstrumentDriver(driver volume.Driver) volume.Driver {
+	return instrumentedDriver{driver}
+}
+
+func observePlugin(method string, start time.Time, res volume.Response) volume.Response {
+	metrics.observeCall(callPlugin, method, start, res.Err != "")
+	return res
+}
+
+func (d instrumentedDriver) Create(req volume.Request) volume.Response {
+	start := time.Now()
+	return observePlugin("Create", start, d.driver.Create(req))
+}
+
+func (d instrumentedDriver) List(req volume.Request) volume.Response {
+	start := time.Now()
+	return observePlugin("List", start, d.driver.List(req))
+}
+
+func (d instrumentedDriver) Get(req volume.Request) volume.Response {
+	start := time.Now()
+	return observePlugin("Get", start, d.driver.Get(req))
+}
+
+func (d instrumentedDriver) Remove(req volume.Request) volume.Response {
+	start := time.Now()
+	return observePlugin("Remove", start, d.driver.Remove(req))
+}
+
+func (d instrumentedDriver) Path(req volume.Request) volume.Response {
+	start := time.Now()
+	return observePlugin("Path", start, d.driver.Path(req))
+}
+
+func (d instrumentedDriver) Mount(req volume.MountRequest) volume.Response {
+	start := time.Now()
+	return observePlugin("Mount", start, d.driver.Mount(req))
+}
+
+func (d instrumentedDriver) Unmount(req volume.UnmountRequest) volume.Response {
+	start := time.Now()
+	return observePlugin("Unmount", start, d.driver.Unmount(req))
+}
+
+func (d instrumentedDriver) Capabilities(req volume.Request) volume.Response {
+	start := time.Now()
+	return observePlugin("Capabilities", start, d.driver.Capabilities(req))
+}
+
+// metricsBackend counts the failures of the backend by operation.
+type metricsBackend struct {
+	Backend
+}
+
+func (backend metricsBackend) count(operation string, err error) error {
+	if err != nil {
+		metrics.countBtrfsFailure(operation)
+	}
+	return err
+}
+
+func (backend metricsBackend) CreateSubvolume(p string) error {
+	return backend.count("subvolume-create", backend.Backend.CreateSubvolume(p))
+}
+
+func (backend metricsBackend) DeleteSubvolume(p string) error {
+	return backend.count("subvolume-delete", backend.Backend.DeleteSubvolume(p))
+}
+
+func (backend metricsBackend) SnapshotSubvolume(src string, dst string, readOnly bool) error {
+	return backend.count("subvolume-snapshot", backend.Backend.SnapshotSubvolume(src, dst, readOnly))
+}
+
+func (backend metricsBackend) ListSubvolumes(root string) ([]string, error) {
+	subvolumes, err := backend.Backend.ListSubvolumes(root)
+	return subvolumes, backend.count("subvolume-list", err)
+}
+
+func (backend metricsBackend) ShowSubvolume(p string) (Subvolume, error) {
+	subvolume, err := backend.Backend.ShowSubvolume(p)
+	return subvolume, backend.count("subvolume-show", err)
+}
+
+func (backend metricsBackend) ShowSubvolumes(dir string) (map[string]Subvolume, error) {
+	subvolumes, err := backend.Backend.ShowSubvolumes(dir)
+	return subvolumes, backend.count("subvolume-list", err)
+}
+
+func (backend metricsBackend) EnableQuota(p string) error {
+	return backend.count("quota-enable", backend.Backend.EnableQuota(p))
+}
+
+func (backend metricsBackend) LimitSubvolume(p string, size uint64) error {
+	return backend.count("qgroup-limit", backend.Backend.LimitSubvolume(p, size))
+}
+
+func (backend metricsBackend) QgroupUsage(p string) (map[uint64]QgroupUsage, error) {
+	usage, err := backend.Backend.QgroupUsage(p)
+	return usage, backend.count("qgroup-usage", err)
+}
+
+func (backend metricsBackend) Send(p string, parent string, out io.Writer) error {
+	return backend.count("send", backend.Backend.Send(p, parent, out))
+}
+
+func (backend metricsBackend) Receive(in io.Reader, dir string) error {
+	return backend.count("receive", backend.Backend.Receive(in, dir))
+}
@@ -0,0 +1,70 @@
+package daemon
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestMetricsRecorder(t *testing.T) {
+	m := newMetricsRecorder()
+	start := time.Now().Add(-2 * time.Second)
+	m.observeCall(callRpc, "CreateSnap", start, false)
+	m.observeCall(callRpc, "CreateSnap", start, true)
+	m.countBtrfsFailure("qgroup-usage")
+
+	var buf bytes.Buffer
+	m.write(&buf)
+	out := buf.String()
+
+	for _, expected := range []string{
+		"# TYPE local_btrfs_rpc_requests_total counter\n",
+		`local_btrfs_rpc_requests_total{method="CreateSnap"} 2`,
+		`local_btrfs_rpc_requests_failed_total{method="CreateSnap"} 1`,
+		`local_btrfs_rpc_request_duration_seconds_bucket{method="CreateSnap",le="1"} 0`,
+		`local_btrfs_rpc_request_duration_seconds_bucket{method="CreateSnap",le="5"} 2`,
+		`local_btrfs_rpc_request_duration_seconds_bucket{method="CreateSnap",le="+Inf"} 2`,
+		`local_btrfs_rpc_request_duration_seconds_count{method="CreateSnap"} 2`,
+		`local_btrfs_btrfs_failures_total{operation="qgroup-usage"} 1`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in\n%v", expected, out)
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	defer func(saved metricsRecorder) { metrics = saved }(metrics)
+	metrics = newMetricsRecorder()
+
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	instrumented := InstrumentDriver(driver)
+	instrumented.Create(volume.Request{Name: defaultTestName, Options: map[string]string{"mountpoint": defaultTestMountpoint}})
+	defer defaultCleanupHelper(driver, t)
+	instrumented.Get(volume.Request{Name: "unknown"})
+
+	now := time.Now()
+	driver.createSnap(defaultTestName, scheduledSnapName(now.Add(-time.Hour)), SnapshotMeta{})
+
+	rec := httptest.NewRecorder()
+	driver.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	out := rec.Body.String()
+
+	for _, expected := range []string{
+		`local_btrfs_plugin_requests_total{method="Create"} 1`,
+		`local_btrfs_plugin_requests_failed_total{method="Get"} 1`,
+		"local_btrfs_volumes 1\n",
+		`local_btrfs_snapshots{volume="` + defaultTestName + `"} 1`,
+		`local_btrfs_last_scheduled_snapshot_age_seconds{volume="` + defaultTestName + `"} 36`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in\n%v", expected, out)
+		}
+	}
+}
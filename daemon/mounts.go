@@ -0,0 +1,89 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// addMount registers the mount with the given ID. Docker may mount a volume
+// several times, e.g. for multiple containers, so each ID is counted once.
+func (driver LocalBtrfsDriver) addMount(volumeName string, id string) error {
+	driver.mutex.Lock()
+	defer driver.mutex.Unlock()
+
+	if _, err := driver.mountPathLocked(volumeName); err != nil {
+		return err
+	}
+
+	for _, mountID := range driver.mounts[volumeName] {
+		if mountID == id {
+			return nil
+		}
+	}
+	driver.mounts[volumeName] = append(driver.mounts[volumeName], id)
+
+	return driver.saveState()
+}
+
+func (driver LocalBtrfsDriver) removeMount(volumeName string, id string) error {
+	driver.mutex.Lock()
+	defer driver.mutex.Unlock()
+
+	ids := driver.mounts[volumeName]
+	for i, mountID := range ids {
+		if mountID == id {
+			ids = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+
+	if len(ids) == 0 {
+		delete(driver.mounts, volumeName)
+	} else {
+		driver.mounts[volumeName] = ids
+	}
+
+	return driver.saveState()
+}
+
+// clearMounts forgets all mounts of the volume. The mounts are persisted, so
+// mounts docker never unmounted, e.g. because it crashed, keep the volume in
+// use until they are cleared. Only containers started afterwards mount the
+// volume again, so this must only be used if no container is using it.
+func (driver LocalBtrfsDriver) clearMounts(volumeName string) (err error) {
+	defer logOperation("clear-mounts", Fields{"volume": volumeName}, time.Now(), &err)
+
+	driver.mutex.Lock()
+	defer driver.mutex.Unlock()
+
+	if _, err := driver.mountPathLocked(volumeName); err != nil {
+		return err
+	}
+	delete(driver.mounts, volumeName)
+
+	return driver.saveState()
+}
+
+func (driver LocalBtrfsDriver) mountCount(volumeName string) int {
+	driver.mutex.RLock()
+	defer driver.mutex.RUnlock()
+	return len(driver.mounts[volumeName])
+}
+
+// checkNotMounted returns an error if containers are using the volume,
+// unless force is set. The caller holds the mutex, so the volume can't be
+// mounted until it is done with the volume.
+func (driver LocalBtrfsDriver) checkNotMounted(volumeName string, force bool) error {
+	count := len(driver.mounts[volumeName])
+	if count == 0 {
+		return nil
+	}
+
+	if force {
+		logger.With(Fields{"volume": volumeName, "mounts": count}).Warn("volume is in use, continuing anyway")
+		return nil
+	}
+
+	return errors.New(fmt.Sprintf("volume %q is in use by %d mount(s), use force to override, or clear-mounts if no container is using it", volumeName, count))
+}
@@ -0,0 +1,94 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var sizeUnits = map[string]uint64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+	"P": 1 << 50,
+}
+
+// parseSize parses sizes like "512M" or "10G" with base 1024 units, like
+// btrfs does. A size of "none" or "0" means no limit and returns 0.
+func parseSize(s string) (uint64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	if value == "NONE" {
+		return 0, nil
+	}
+
+	value = strings.TrimSuffix(value, "B")
+	// "i" is only allowed with a unit, as in "GiB"
+	binary := strings.HasSuffix(value, "I")
+	value = strings.TrimSuffix(value, "I")
+	unit := ""
+	if len(value) > 0 {
+		if _, ok := sizeUnits[value[len(value)-1:]]; ok {
+			unit = value[len(value)-1:]
+			value = value[:len(value)-1]
+		}
+	}
+
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || (binary && unit == "") {
+		return 0, errors.New(fmt.Sprintf("invalid size %q", s))
+	}
+	if n > math.MaxUint64/sizeUnits[unit] {
+		return 0, errors.New(fmt.Sprintf("size %q is too large", s))
+	}
+	return n * sizeUnits[unit], nil
+}
+
+// applySizeLimit enables quotas on the filesystem of the volume and limits
+// the current subvolume to size bytes. A size of 0 removes the limit.
+func (driver LocalBtrfsDriver) applySizeLimit(volumePath string, size uint64) error {
+	currentPath := volumePath + "/current"
+
+	if size == 0 {
+		return driver.backend.LimitSubvolume(currentPath, 0)
+	}
+
+	if err := driver.backend.EnableQuota(volumePath); err != nil {
+		return err
+	}
+
+	logger.With(Fields{"path": currentPath, "size": size}).Debug("limiting size")
+	return driver.backend.LimitSubvolume(currentPath, size)
+}
+
+func (driver LocalBtrfsDriver) resizeVolume(volumeName string, size uint64) (err error) {
+	defer logOperation("resize", Fields{"volume": volumeName, "size": size}, time.Now(), &err)
+
+	driver.mutex.Lock()
+	defer driver.mutex.Unlock()
+
+	volumePath, err := driver.getVolumePathLocked(volumeName)
+	if err != nil {
+		return err
+	}
+
+	if err := driver.applySizeLimit(volumePath, size); err != nil {
+		return err
+	}
+
+	if size == 0 {
+		delete(driver.sizes, volumeName)
+	} else {
+		driver.sizes[volumeName] = size
+	}
+
+	if err := driver.saveState(); err != nil {
+		logger.WithError(err).Error("could not save state")
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package daemon
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	sizes := map[string]uint64{
+		"1024":   1024,
+		"10G":    10 << 30,
+		"512m":   512 << 20,
+		"2GiB":   2 << 30,
+		"1TB":    1 << 40,
+		"none":   0,
+		"0":      0,
+		" 8K ":   8 << 10,
+		"16383P": 16383 << 50,
+	}
+	for s, expected := range sizes {
+		size, err := parseSize(s)
+		if err != nil {
+			t.Errorf("Could not parse %q: %v", s, err)
+		} else if size != expected {
+			t.Errorf("Expected %d for %q, got %d", expected, s, size)
+		}
+	}
+
+	for _, s := range []string{"", "G", "ten", "-1G", "10X", "10I", "10iB", "99999999999999999999T", "16384P", "18446744073709551616"} {
+		if _, err := parseSize(s); err == nil {
+			t.Errorf("Should fail to parse %q", s)
+		}
+	}
+}
+
+func TestCreateVolume_sizeLimitFailureRollsBack(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	defaultCreateHelper(driver, t)
+	defer defaultCleanupHelper(driver, t)
+	driver.createSnap(defaultTestName, "snap", SnapshotMeta{})
+
+	clone := defaultTestName + "-clone"
+	mountpoint := defaultTestMountpoint + "-clone"
+	options := volumeOptions{fromVolume: defaultTestName, fromSnapshot: "snap", size: 1 << 20}
+	backend := driver.backend
+	driver.backend = failingBackend{Backend: backend, fail: func(op string, p string) bool { return op == "limit" }}
+	if err := driver.createVolume(clone, mountpoint, options); err == nil {
+		t.Fatal("Expected create to fail")
+	}
+	if _, err := os.Stat(mountpoint); !os.IsNotExist(err) {
+		t.Errorf("Expected %v to be removed, got %v", mountpoint, err)
+	}
+
+	driver.backend = backend
+	if err := driver.createVolume(clone, mountpoint, options); err != nil {
+		t.Fatal("Expected retried clone to succeed:", err)
+	}
+	cleanupHelper(driver, t, clone, mountpoint)
+}
@@ -0,0 +1,202 @@
+package daemon
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// RecoveryOrphaned volumes exist on disk but not in the state file.
+	RecoveryOrphaned = "orphaned"
+	// RecoveryMissing volumes exist in the state file but not on disk.
+	RecoveryMissing = "missing"
+	// RecoveryMismatched volumes exist on disk, but their name is registered
+	// with another mountpoint.
+	RecoveryMismatched = "mismatched"
+)
+
+type RecoveryEntry struct {
+	Volume     string
+	Mountpoint string
+	Status     string
+	Registered bool
+}
+
+type RecoveryReport struct {
+	Entries []RecoveryEntry
+}
+
+// Recover scans root for volumes created by createVolume, i.e. directories
+// with a current subvolume and a snaps directory, and compares them with the known volumes.
+// Orphaned volumes are registered unless dryRun is set.
+func (driver LocalBtrfsDriver) Recover(root string, dryRun bool) (RecoveryReport, error) {
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return RecoveryReport{}, err
+	}
+
+	subvolumes, err := driver.backend.ListSubvolumes(root)
+	if err != nil {
+		return RecoveryReport{}, err
+	}
+	found := findVolumeLayouts(root, subvolumes)
+
+	driver.mutex.Lock()
+	defer driver.mutex.Unlock()
+
+	report := compareVolumes(found, driver.volumes, root)
+	if dryRun {
+		return report, nil
+	}
+
+	changed := false
+	for i, entry := range report.Entries {
+		if entry.Status != RecoveryOrphaned {
+			continue
+		}
+		driver.volumes[entry.Volume] = entry.Mountpoint
+		report.Entries[i].Registered = true
+		changed = true
+		logger.With(Fields{"operation": "recover", "volume": entry.Volume, "mountpoint": entry.Mountpoint}).Info("recovered volume")
+	}
+
+	if changed {
+		if err := driver.saveState(); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// findMount returns the mount point containing dir and the path of the
+// mounted directory within its filesystem from the content of
+// /proc/self/mountinfo.
+func findMount(mountinfo string, dir string) (string, string, error) {
+	mnt, fsRoot := "", ""
+	for _, line := range strings.Split(mountinfo, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		mountPoint := fields[4]
+		if mountPoint != "/" && dir != mountPoint && !strings.HasPrefix(dir, mountPoint+"/") {
+			continue
+		}
+		// later mounts on the same mount point hide earlier ones
+		if len(mountPoint) >= len(mnt) {
+			mnt, fsRoot = mountPoint, fields[3]
+		}
+	}
+
+	if mnt == "" {
+		return "", "", errors.New("could not find mount point of " + dir)
+	}
+	return mnt, fsRoot, nil
+}
+
+// parseSubvolumeList returns the paths from the output of `btrfs subvolume list`.
+func parseSubvolumeList(output string) []string {
+	var paths []string
+	for _, line := range strings.Split(output, "\n") {
+		i := strings.Index(line, " path ")
+		if i < 0 {
+			continue
+		}
+		paths = append(paths, strings.TrimPrefix(line[i+len(" path "):], "<FS_TREE>/"))
+	}
+	return paths
+}
+
+// findVolumeLayouts returns the mountpoints of all volumes in the given
+// subvolume paths below root, sorted. Volumes have a current subvolume and a
+// snaps directory. Snapshots may contain the layout as well, so paths below
+// a snaps directory are skipped, as are directories not named like a volume,
+// e.g. "vol@snap" is addressed as snapshot volume.
+func findVolumeLayouts(root string, subvolumes []string) []string {
+	var mountpoints []string
+	for _, subvolume := range subvolumes {
+		if path.Base(subvolume) != "current" {
+			continue
+		}
+		mountpoint := path.Dir(subvolume)
+		rel := strings.TrimPrefix(mountpoint, strings.TrimSuffix(root, "/")+"/")
+		if underSnaps(rel) {
+			continue
+		}
+		if fi, err := os.Stat(mountpoint + "/snaps"); err != nil || !fi.IsDir() {
+			continue
+		}
+		if err := validateVolumeName(path.Base(mountpoint)); err != nil {
+			logger.With(Fields{"operation": "recover", "mountpoint": mountpoint}).WithError(err).Warn("ignoring volume")
+			continue
+		}
+		mountpoints = append(mountpoints, mountpoint)
+	}
+	sort.Strings(mountpoints)
+	return mountpoints
+}
+
+// underSnaps returns true if any parent directory of the relative path is a
+// snaps directory.
+func underSnaps(rel string) bool {
+	for _, dir := range strings.Split(path.Dir(rel), "/") {
+		if dir == "snaps" {
+			return true
+		}
+	}
+	return false
+}
+
+// compareVolumes compares the mountpoints found on disk with the known
+// volumes. Found volumes are named after their mountpoint directory. Only
+// known volumes below root can be missing.
+func compareVolumes(found []string, volumes map[string]string, root string) RecoveryReport {
+	report := RecoveryReport{}
+
+	known := map[string]bool{}
+	for _, mountpoint := range volumes {
+		known[path.Clean(mountpoint)] = true
+	}
+
+	names := map[string]string{}
+	for name, mountpoint := range volumes {
+		names[name] = mountpoint
+	}
+
+	onDisk := map[string]bool{}
+	for _, mountpoint := range found {
+		onDisk[mountpoint] = true
+		if known[mountpoint] {
+			continue
+		}
+
+		name := path.Base(mountpoint)
+		status := RecoveryOrphaned
+		if _, taken := names[name]; taken {
+			status = RecoveryMismatched
+		} else {
+			names[name] = mountpoint
+		}
+		report.Entries = append(report.Entries, RecoveryEntry{Volume: name, Mountpoint: mountpoint, Status: status})
+	}
+
+	var missing []string
+	for name, mountpoint := range volumes {
+		mountpoint = path.Clean(mountpoint)
+		if onDisk[mountpoint] || !strings.HasPrefix(mountpoint+"/", strings.TrimSuffix(root, "/")+"/") {
+			continue
+		}
+		missing = append(missing, name)
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		report.Entries = append(report.Entries, RecoveryEntry{Volume: name, Mountpoint: volumes[name], Status: RecoveryMissing})
+	}
+
+	return report
+}
@@ -0,0 +1,104 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSubvolumeList(t *testing.T) {
+	output := `ID 257 gen 12 top level 5 path acceptance/myvol1/current
+ID 258 gen 13 top level 5 path acceptance/myvol1/snaps/snap 1
+ID 259 gen 14 top level 5 path <FS_TREE>/other/current
+`
+
+	expected := []string{"acceptance/myvol1/current", "acceptance/myvol1/snaps/snap 1", "other/current"}
+	if paths := parseSubvolumeList(output); !reflect.DeepEqual(expected, paths) {
+		t.Errorf("Expected %v, got %v", expected, paths)
+	}
+}
+
+func TestFindVolumeLayouts(t *testing.T) {
+	root, err := ioutil.TempDir("", "local-btrfs-recover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	var subvolumes []string
+	for _, dir := range []string{
+		"vol2/current",
+		"vol2/snaps/snap1",
+		"vol1/current",
+		"vol1/snaps",
+		"vol1/snaps/snap1/current",
+		"vol1/snaps/snap1/snaps",
+		"sub/vol3/current",
+		"sub/vol3/snaps",
+		"no-snaps/current",
+		"vol@snap/current",
+		"vol@snap/snaps",
+		"other",
+	} {
+		if err := os.MkdirAll(path.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		// snaps directories aren't subvolumes
+		if !strings.HasSuffix(dir, "/snaps") {
+			subvolumes = append(subvolumes, path.Join(root, dir))
+		}
+	}
+
+	expected := []string{root + "/sub/vol3", root + "/vol1", root + "/vol2"}
+	if found := findVolumeLayouts(root, subvolumes); !reflect.DeepEqual(expected, found) {
+		t.Errorf("Expected %v, got %v", expected, found)
+	}
+}
+
+func TestCompareVolumes(t *testing.T) {
+	found := []string{"/btrfs/known", "/btrfs/orphan", "/btrfs/taken", "/btrfs/sub/orphan"}
+	volumes := map[string]string{
+		"renamed": "/btrfs/known/",
+		"taken":   "/elsewhere/taken",
+		"gone":    "/btrfs/gone",
+		"outside": "/data/outside",
+	}
+
+	report := compareVolumes(found, volumes, "/btrfs")
+
+	expected := []RecoveryEntry{
+		{Volume: "orphan", Mountpoint: "/btrfs/orphan", Status: RecoveryOrphaned},
+		{Volume: "taken", Mountpoint: "/btrfs/taken", Status: RecoveryMismatched},
+		{Volume: "orphan", Mountpoint: "/btrfs/sub/orphan", Status: RecoveryMismatched},
+		{Volume: "gone", Mountpoint: "/btrfs/gone", Status: RecoveryMissing},
+	}
+	if !reflect.DeepEqual(expected, report.Entries) {
+		t.Errorf("Expected %+v, got %+v", expected, report.Entries)
+	}
+}
+
+func TestFindMount(t *testing.T) {
+	mountinfo := `17 0 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+40 17 0:35 / /btrfs rw,relatime shared:20 - btrfs /dev/loop0 rw,space_cache
+41 17 0:36 /@data /data rw,relatime shared:21 - btrfs /dev/loop1 rw,subvol=/@data
+`
+
+	cases := map[string][2]string{
+		"/btrfs/acceptance": {"/btrfs", "/"},
+		"/btrfs":            {"/btrfs", "/"},
+		"/data/volumes":     {"/data", "/@data"},
+		"/btrfs-backup":     {"/", "/"},
+	}
+	for dir, expected := range cases {
+		mnt, fsRoot, err := findMount(mountinfo, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mnt != expected[0] || fsRoot != expected[1] {
+			t.Errorf("Expected %v for %v, got %v %v", expected, dir, mnt, fsRoot)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// BrowseEntry is an entry of a directory in a snapshot.
+type BrowseEntry struct {
+	Name    string
+	Dir     bool
+	Mode    string
+	Size    int64
+	ModTime time.Time
+	// Target is the target of symlinks.
+	Target string `json:",omitempty"`
+}
+
+type BrowseReply struct {
+	Path    string
+	Entries []BrowseEntry
+}
+
+// browseSnapshot lists the directory at p in the snapshot, or returns the
+// entry itself if p is no directory.
+func (driver LocalBtrfsDriver) browseSnapshot(volumeName string, snapshotName string, p string) (BrowseReply, error) {
+	snapPath, err := driver.existingSnapshotPath(volumeName, snapshotName)
+	if err != nil {
+		return BrowseReply{}, err
+	}
+	rel := cleanVolumePath(p)
+	dir, file, err := openInTree(snapPath, rel)
+	if err != nil {
+		return BrowseReply{}, err
+	}
+	defer dir.Close()
+
+	fi, err := os.Lstat(file)
+	if err != nil {
+		return BrowseReply{}, err
+	}
+	reply := BrowseReply{Path: "/" + rel}
+	if !fi.IsDir() {
+		reply.Entries = []BrowseEntry{browseEntry(file, fi)}
+		return reply, nil
+	}
+
+	infos, err := ioutil.ReadDir(file)
+	if err != nil {
+		return BrowseReply{}, err
+	}
+	for _, info := range infos {
+		reply.Entries = append(reply.Entries, browseEntry(path.Join(file, info.Name()), info))
+	}
+	return reply, nil
+}
+
+func browseEntry(file string, fi os.FileInfo) BrowseEntry {
+	entry := BrowseEntry{
+		Name:    fi.Name(),
+		Dir:     fi.IsDir(),
+		Mode:    fi.Mode().String(),
+		Size:    entrySize(fi),
+		ModTime: fi.ModTime(),
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		entry.Target, _ = os.Readlink(file)
+	}
+	return entry
+}
+
+// restorePath copies the file or directory tree at p in the snapshot into the
+// current state of the volume, at dest or at the same path if dest is "".
+// Files are reflinked, so no data is copied on btrfs. An existing destination
+// is only replaced with overwrite, and only once the copy is complete.
+func (driver LocalBtrfsDriver) restorePath(volumeName string, snapshotName string, p string, dest string, overwrite bool) (err error) {
+	defer logOperation("restore-path", Fields{"volume": volumeName, "snapshot": snapshotName, "path": p, "dest": dest}, time.Now(), &err)
+
+	// a restore of the volume must not replace current during the copy, the
+	// rest of the copy would end up in the replaced state
+	driver.mutex.Lock()
+	defer driver.mutex.Unlock()
+
+	snapPath, err := driver.existingSnapshotPathLocked(volumeName, snapshotName)
+	if err != nil {
+		return err
+	}
+	volumePath, err := driver.getVolumePathLocked(volumeName)
+	if err != nil {
+		return err
+	}
+	currentPath := volumePath + "/current"
+
+	rel := cleanVolumePath(p)
+	if dest == "" {
+		dest = rel
+	}
+	destRel := cleanVolumePath(dest)
+	if rel == "" || destRel == "" {
+		return errors.New("use `snap restore` to restore the whole volume")
+	}
+
+	srcDir, src, err := openInTree(snapPath, rel)
+	if err != nil {
+		return err
+	}
+	defer srcDir.Close()
+	if _, err := os.Lstat(src); err != nil {
+		return errors.New(fmt.Sprintf("%v does not exist in snapshot %q", "/"+rel, snapshotName))
+	}
+
+	targetDir, target, err := openInTree(currentPath, destRel)
+	if err != nil {
+		return err
+	}
+	defer targetDir.Close()
+	_, statErr := os.Lstat(target)
+	if statErr == nil && !overwrite {
+		return errors.New(fmt.Sprintf("%v already exists in volume %q, use overwrite to replace it", "/"+destRel, volumeName))
+	}
+
+	// copy beside the target, so replacing it is a rename
+	tmp := path.Join(path.Dir(target), fmt.Sprintf(".%v.restore-%d", path.Base(target), time.Now().UnixNano()))
+	if err := reflinkTree(src, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if statErr == nil {
+		if err := os.RemoveAll(target); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+	}
+	return os.Rename(tmp, target)
+}
+
+func (driver LocalBtrfsDriver) existingSnapshotPath(volumeName string, snapshotName string) (string, error) {
+	driver.mutex.RLock()
+	defer driver.mutex.RUnlock()
+	return driver.existingSnapshotPathLocked(volumeName, snapshotName)
+}
+
+// existingSnapshotPathLocked is existingSnapshotPath for callers holding the
+// mutex.
+func (driver LocalBtrfsDriver) existingSnapshotPathLocked(volumeName string, snapshotName string) (string, error) {
+	volumePath, err := driver.getVolumePathLocked(volumeName)
+	if err != nil {
+		return "", err
+	}
+	snapPath, err := driver.getSnapshotPath(volumePath, snapshotName)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(snapPath); os.IsNotExist(err) {
+		return "", errors.New(fmt.Sprintf("snapshot %q does not exist for volume %q (%v)", snapshotName, volumeName, snapPath))
+	}
+	return snapPath, nil
+}
+
+// cleanVolumePath returns p relative to the root of the volume, which is the
+// root directory containers see, so p can't leave it with "..".
+func cleanVolumePath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// openInTree opens the parent directory of rel below root and returns it
+// with the path of rel through the opened directory. The directories are
+// opened one by one without following symlinks, as those are meant to be
+// followed inside containers and could point anywhere on the host. As the
+// returned path refers to the opened directory, replacing a parent with a
+// symlink afterwards doesn't redirect it either. The directory must be closed
+// once the path isn't used anymore.
+func openInTree(root string, rel string) (*os.File, string, error) {
+	fd, err := unix.Open(root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, "", &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	parts := strings.Split(rel, "/")
+	for i, part := range parts[:len(parts)-1] {
+		next, err := unix.Openat(fd, part, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		unix.Close(fd)
+		switch err {
+		case unix.ENOENT:
+			return nil, "", errors.New(fmt.Sprintf("directory /%v does not exist", strings.Join(parts[:i+1], "/")))
+		case unix.ENOTDIR, unix.ELOOP:
+			return nil, "", errors.New(fmt.Sprintf("/%v is a symlink or no directory", strings.Join(parts[:i+1], "/")))
+		}
+		if err != nil {
+			return nil, "", &os.PathError{Op: "open", Path: path.Join(root, strings.Join(parts[:i+1], "/")), Err: err}
+		}
+		fd = next
+	}
+
+	dir := os.NewFile(uintptr(fd), path.Join(root, path.Dir(rel)))
+	name := parts[len(parts)-1]
+	if name == "" {
+		name = "."
+	}
+	return dir, fmt.Sprintf("/proc/self/fd/%d/%s", fd, name), nil
+}
+
+// reflinkTree copies the tree at src to dst, which must not exist, keeping
+// modes, times and, when running as root, owners.
+func reflinkTree(src string, dst string) error {
+	var dirs []string
+	err := filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		target := dst + strings.TrimPrefix(file, src)
+
+		switch {
+		case fi.IsDir():
+			if err := os.Mkdir(target, fi.Mode().Perm()); err != nil {
+				return err
+			}
+			// times of directories change with their entries, so they are set last
+			dirs = append(dirs, file)
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		case fi.Mode().IsRegular():
+			if err := reflinkFile(file, target, fi.Mode().Perm()); err != nil {
+				return err
+			}
+		default:
+			logger.With(Fields{"path": file}).Warn("skipping special file")
+			return nil
+		}
+		return copyAttributes(target, fi)
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if err := os.Chtimes(dst+strings.TrimPrefix(dir, src), fi.ModTime(), fi.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reflinkFile clones src to dst, falling back to copying where reflinks
+// aren't supported, e.g. across filesystems.
+func reflinkFile(src string, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, out.Fd(), iocClone, in.Fd())
+	if errno != 0 {
+		logger.With(Fields{"path": src}).WithError(errno).Debug("reflink failed, copying")
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	// errors of delayed writes only show up on close
+	return out.Close()
+}
+
+func copyAttributes(target string, fi os.FileInfo) error {
+	if os.Geteuid() == 0 {
+		if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+			if err := os.Lchown(target, int(stat.Uid), int(stat.Gid)); err != nil {
+				return err
+			}
+		}
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	// chown clears the setuid bits
+	if err := os.Chmod(target, fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(target, fi.ModTime(), fi.ModTime())
+}
@@ -0,0 +1,167 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCleanVolumePath(t *testing.T) {
+	paths := map[string]string{
+		"":                 "",
+		"/":                "",
+		"etc/app.conf":     "etc/app.conf",
+		"/etc/app.conf":    "etc/app.conf",
+		"../../etc/passwd": "etc/passwd",
+		"a/../../b":        "b",
+	}
+	for p, expected := range paths {
+		if actual := cleanVolumePath(p); actual != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, p, actual)
+		}
+	}
+}
+
+func TestRestorePath(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	defaultCreateHelper(driver, t)
+	defer defaultCleanupHelper(driver, t)
+
+	current := defaultTestMountpoint + "/current"
+	writeTree(t, current, map[string]string{
+		"app.conf":      "config",
+		"data/a":        "a",
+		"data/nested/b": "b",
+		"other":         "other",
+	})
+	mtime := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(current+"/app.conf", mtime, mtime)
+	os.Chmod(current+"/app.conf", 0600)
+	driver.createSnap(defaultTestName, "snap", SnapshotMeta{})
+
+	os.Remove(current + "/app.conf")
+	os.RemoveAll(current + "/data")
+	ioutil.WriteFile(current+"/other", []byte("changed"), 0644)
+
+	if err := driver.restorePath(defaultTestName, "snap", "/app.conf", "", false); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(current + "/app.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(current + "/app.conf"); string(content) != "config" {
+		t.Errorf("Expected restored content, got %q", content)
+	}
+	if fi.Mode().Perm() != 0600 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("Expected mode and time to be kept, got %v %v", fi.Mode(), fi.ModTime())
+	}
+
+	if err := driver.restorePath(defaultTestName, "snap", "data", "restored", false); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(current + "/restored/nested/b"); string(content) != "b" {
+		t.Errorf("Expected restored tree, got %q", content)
+	}
+
+	if err := driver.restorePath(defaultTestName, "snap", "other", "", false); err == nil {
+		t.Error("Expected error for existing destination")
+	}
+	if err := driver.restorePath(defaultTestName, "snap", "other", "", true); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(current + "/other"); string(content) != "other" {
+		t.Errorf("Expected overwritten content, got %q", content)
+	}
+
+	if err := driver.restorePath(defaultTestName, "snap", "missing", "", false); err == nil {
+		t.Error("Expected error for path missing in snapshot")
+	}
+	if err := driver.restorePath(defaultTestName, "snap", "/", "", false); err == nil {
+		t.Error("Expected error for the whole volume")
+	}
+
+	// symlinks in the volume must not redirect the restore to the host
+	os.Symlink(driver.config.StateDir, current+"/link")
+	if err := driver.restorePath(defaultTestName, "snap", "app.conf", "link/app.conf", false); err == nil {
+		t.Error("Expected error for destination below symlink")
+	}
+	if _, err := os.Stat(driver.config.StateDir + "/app.conf"); !os.IsNotExist(err) {
+		t.Error("Restore should not follow symlinks")
+	}
+}
+
+func TestOpenInTree(t *testing.T) {
+	root, err := ioutil.TempDir("", "local-btrfs-tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(root+"/volume/dir", 0755)
+	os.Mkdir(root+"/host", 0755)
+	os.Symlink(root+"/host", root+"/volume/link")
+
+	if _, _, err := openInTree(root+"/volume", "link/file"); err == nil {
+		t.Error("Expected error for path below symlink")
+	}
+	if _, _, err := openInTree(root+"/volume", "missing/file"); err == nil {
+		t.Error("Expected error for missing directory")
+	}
+
+	dir, file, err := openInTree(root+"/volume", "dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+
+	// a container replacing the directory with a symlink once it's checked
+	os.Rename(root+"/volume/dir", root+"/volume/moved")
+	os.Symlink(root+"/host", root+"/volume/dir")
+	if err := ioutil.WriteFile(file, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(root + "/host/file"); !os.IsNotExist(err) {
+		t.Error("Expected the opened directory to be used, not the symlink")
+	}
+	if _, err := os.Stat(root + "/volume/moved/file"); err != nil {
+		t.Error("Expected the file in the opened directory:", err)
+	}
+}
+
+func TestBrowseSnapshot(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	defaultCreateHelper(driver, t)
+	defer defaultCleanupHelper(driver, t)
+
+	current := defaultTestMountpoint + "/current"
+	writeTree(t, current, map[string]string{"file": "content", "dir/nested": "x"})
+	os.Symlink("file", current+"/link")
+	driver.createSnap(defaultTestName, "snap", SnapshotMeta{})
+
+	reply, err := driver.browseSnapshot(defaultTestName, "snap", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Path != "/" || len(reply.Entries) != 3 {
+		t.Fatalf("Unexpected listing %+v", reply)
+	}
+	dir, file, link := reply.Entries[0], reply.Entries[1], reply.Entries[2]
+	if dir.Name != "dir" || !dir.Dir || file.Name != "file" || file.Size != 7 || link.Target != "file" {
+		t.Errorf("Unexpected entries %+v", reply.Entries)
+	}
+
+	reply, err = driver.browseSnapshot(defaultTestName, "snap", "dir/nested")
+	if err != nil || len(reply.Entries) != 1 || reply.Entries[0].Name != "nested" {
+		t.Errorf("Expected the file itself, got %+v (%v)", reply, err)
+	}
+
+	if _, err := driver.browseSnapshot(defaultTestName, "snap", "missing"); err == nil {
+		t.Error("Expected error for missing path")
+	}
+}
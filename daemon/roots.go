@@ -0,0 +1,67 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// volumeNamePattern is the pattern docker uses for volume names. It keeps
+// names from escaping their root directory.
+var volumeNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+func validateVolumeName(name string) error {
+	if !volumeNamePattern.MatchString(name) {
+		return errors.New(fmt.Sprintf("invalid volume name %q, only [a-zA-Z0-9][a-zA-Z0-9_.-]* is allowed", name))
+	}
+	return nil
+}
+
+// validateSnapshotName checks a snapshot name like a volume name. Snapshots
+// are directories next to each other, so ".." would escape them as well.
+func validateSnapshotName(name string) error {
+	if !volumeNamePattern.MatchString(name) || strings.Contains(name, "/") || strings.Contains(name, "..") {
+		return errors.New(fmt.Sprintf("invalid snapshot name %q, only [a-zA-Z0-9][a-zA-Z0-9_.-]* without \"..\" is allowed", name))
+	}
+	return nil
+}
+
+// resolveMountpoint returns the mountpoint of a new volume. Without explicit
+// mountpoint the volume is placed in the root directory with the given name,
+// or in the default root.
+func (config Config) resolveMountpoint(name string, mountpoint string, root string) (string, error) {
+	if mountpoint != "" {
+		if root != "" {
+			return "", errors.New("The `mountpoint` and `root` options are mutually exclusive")
+		}
+		return mountpoint, nil
+	}
+
+	rootDir := config.DefaultRoot
+	if root != "" {
+		var ok bool
+		if rootDir, ok = config.Roots[root]; !ok {
+			return "", errors.New(fmt.Sprintf("unknown root %q, configured roots are %v", root, config.rootNames()))
+		}
+	}
+	if rootDir == "" {
+		return "", errors.New("The `mountpoint` option is required")
+	}
+
+	if err := validateVolumeName(name); err != nil {
+		return "", err
+	}
+	return path.Join(rootDir, name), nil
+}
+
+func (config Config) rootNames() []string {
+	var names []string
+	for name := range config.Roots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,68 @@
+package daemon
+
+import "testing"
+
+func TestValidateVolumeName(t *testing.T) {
+	for _, name := range []string{"data", "my-vol_1.2", "A"} {
+		if err := validateVolumeName(name); err != nil {
+			t.Errorf("%q should be valid, got %v", name, err)
+		}
+	}
+
+	for _, name := range []string{"", "..", "../etc", "a/b", ".hidden", "-flag", "with space"} {
+		if err := validateVolumeName(name); err == nil {
+			t.Errorf("%q should be invalid", name)
+		}
+	}
+}
+
+func TestValidateSnapshotName(t *testing.T) {
+	for _, name := range []string{"snap1", "auto-20200101-120000", "v1.2"} {
+		if err := validateSnapshotName(name); err != nil {
+			t.Errorf("%q should be valid, got %v", name, err)
+		}
+	}
+
+	for _, name := range []string{"", "..", "a..", "a/../b", "../etc", ".hidden", "a@b"} {
+		if err := validateSnapshotName(name); err == nil {
+			t.Errorf("%q should be invalid", name)
+		}
+	}
+}
+
+func TestResolveMountpoint(t *testing.T) {
+	config := DefaultConfig()
+	config.DefaultRoot = "/btrfs/volumes"
+	config.Roots = map[string]string{"fast": "/ssd/volumes"}
+
+	cases := []struct {
+		name, mountpoint, root, expected string
+	}{
+		{"data", "", "", "/btrfs/volumes/data"},
+		{"data", "", "fast", "/ssd/volumes/data"},
+		{"data", "/somewhere/else", "", "/somewhere/else"},
+	}
+	for _, c := range cases {
+		mountpoint, err := config.resolveMountpoint(c.name, c.mountpoint, c.root)
+		if err != nil || mountpoint != c.expected {
+			t.Errorf("Expected %v for %+v, got %v (%v)", c.expected, c, mountpoint, err)
+		}
+	}
+
+	errorCases := []struct {
+		name, mountpoint, root string
+	}{
+		{"../data", "", ""},
+		{"data", "", "slow"},
+		{"data", "/somewhere/else", "fast"},
+	}
+	for _, c := range errorCases {
+		if _, err := config.resolveMountpoint(c.name, c.mountpoint, c.root); err == nil {
+			t.Errorf("Expected error for %+v", c)
+		}
+	}
+
+	if _, err := DefaultConfig().resolveMountpoint("data", "", ""); err == nil || err.Error() != "The `mountpoint` option is required" {
+		t.Error("Mountpoint should be required without default root, got", err)
+	}
+}
@@ -1,77 +1,554 @@
 package daemon
 
 import (
+	"errors"
 	"fmt"
-	"strconv"
-	"strings"
+	"time"
+)
+
+const (
+	// ProtocolVersion is increased on incompatible changes of the RPC API
+	// between CLI and daemon.
+	ProtocolVersion = 2
+
+	// RpcServiceName is the name the RpcApi is registered with.
+	RpcServiceName = "LocalBtrfs"
 )
 
 type RpcApi struct {
 	Driver LocalBtrfsDriver
 }
 
-func (api RpcApi) CreateVolume(args []string, result *string) error {
-	return api.Driver.createVolume(args[0], args[1])
+type HandshakeArgs struct {
+	Version int
+}
+
+type HandshakeReply struct {
+	Version int
+}
+
+// Ack is the reply of methods that have no result.
+type Ack struct {
+	Ok bool
+}
+
+type VolumeArgs struct {
+	Volume string
+}
+
+// CreateVolumeArgs place the volume in Root, or the default root, if
+// Mountpoint is empty.
+type CreateVolumeArgs struct {
+	Volume     string
+	Mountpoint string
+	Root       string
+	Size       string
+}
+
+type CloneVolumeArgs struct {
+	SourceVolume string
+	Snapshot     string
+	Volume       string
+	Mountpoint   string
+	Root         string
+}
+
+type ResizeVolumeArgs struct {
+	Volume string
+	Size   string
+}
+
+type RemoveVolumeArgs struct {
+	Volume string
+	Purge  bool
+	Force  bool
+}
+
+type ImportVolumeArgs struct {
+	Volume     string
+	Mountpoint string
+	File       string
+}
+
+type SnapshotArgs struct {
+	Volume   string
+	Snapshot string
+}
+
+type CreateSnapArgs struct {
+	Volume      string
+	Snapshot    string
+	Description string
+	// Labels are given as "key=value".
+	Labels []string
+}
+
+// CreateGroupSnapArgs take snapshots of all Volumes as group snapshot.
+type CreateGroupSnapArgs struct {
+	Group       string
+	Volumes     []string
+	Snapshot    string
+	Description string
+	Labels      []string
+}
+
+// ListSnapshotsArgs filter and sort the listed snapshots. Snapshots are
+// sorted by name unless Sort is "created".
+type ListSnapshotsArgs struct {
+	Volume  string
+	Since   *time.Time
+	Until   *time.Time
+	Labels  []string
+	Sort    string
+	Reverse bool
+}
+
+// DiffSnapsArgs compare the snapshot From with To, a snapshot or "current".
+type DiffSnapsArgs struct {
+	Volume string
+	From   string
+	To     string
+}
+
+// RestorePathArgs copy Path from the snapshot to Dest in the current state,
+// or to the same path if Dest is empty.
+type RestorePathArgs struct {
+	Volume    string
+	Snapshot  string
+	Path      string
+	Dest      string
+	Overwrite bool
+}
+
+type BrowseSnapArgs struct {
+	Volume   string
+	Snapshot string
+	Path     string
+}
+
+type RestoreSnapArgs struct {
+	Volume   string
+	Snapshot string
+	Force    bool
+	// NoBackup skips the pre-restore snapshot of the previous state.
+	NoBackup bool
+}
+
+type RestoreGroupSnapArgs struct {
+	Group    string
+	Snapshot string
+	Force    bool
+	NoBackup bool
+}
+
+type SendSnapArgs struct {
+	Volume    string
+	Snapshot  string
+	TargetDir string
+}
+
+type ExportSnapArgs struct {
+	Volume   string
+	Snapshot string
+	File     string
+	Compress bool
+}
+
+type ImportSnapArgs struct {
+	Volume   string
+	File     string
+	Snapshot string
+}
+
+type RecoverArgs struct {
+	Root   string
+	DryRun bool
+}
+
+type SnapshotList struct {
+	Snapshots []SnapshotInfo
+}
+
+type PathReply struct {
+	Path string
+}
+
+type VolumeList struct {
+	Volumes []VolumeInfo
+}
+
+// Handshake reports the protocol version of the daemon. The client is
+// expected to check it with CheckProtocolVersion before further calls.
+func (api RpcApi) Handshake(args HandshakeArgs, reply *HandshakeReply) (err error) {
+	defer observeRpc("Handshake", time.Now(), &err)
+	reply.Version = ProtocolVersion
+	if args.Version != ProtocolVersion {
+		logger.With(Fields{"client_version": args.Version, "version": ProtocolVersion}).Warn("client with other protocol version connected")
+	}
+	return nil
+}
+
+func CheckProtocolVersion(reply HandshakeReply) error {
+	if reply.Version != ProtocolVersion {
+		return errors.New(fmt.Sprintf("protocol version mismatch: CLI uses version %d, daemon uses version %d; please use matching versions of CLI and daemon", ProtocolVersion, reply.Version))
+	}
+	return nil
+}
+
+func (api RpcApi) CreateVolume(args CreateVolumeArgs, reply *Ack) (err error) {
+	defer observeRpc("CreateVolume", time.Now(), &err)
+	options := volumeOptions{}
+	if args.Size != "" {
+		size, err := parseSize(args.Size)
+		if err != nil {
+			return err
+		}
+		options.size = size
+	}
+
+	mountpoint, err := api.Driver.config.resolveMountpoint(args.Volume, args.Mountpoint, args.Root)
+	if err != nil {
+		return err
+	}
+	return ack(reply, api.Driver.createVolume(args.Volume, mountpoint, options))
+}
+
+func (api RpcApi) CloneVolume(args CloneVolumeArgs, reply *Ack) (err error) {
+	defer observeRpc("CloneVolume", time.Now(), &err)
+	if err := validateOptionalSnapshotName(args.Snapshot); err != nil {
+		return err
+	}
+	options := volumeOptions{fromVolume: args.SourceVolume, fromSnapshot: args.Snapshot}
+
+	mountpoint, err := api.Driver.config.resolveMountpoint(args.Volume, args.Mountpoint, args.Root)
+	if err != nil {
+		return err
+	}
+	return ack(reply, api.Driver.createVolume(args.Volume, mountpoint, options))
+}
+
+func (api RpcApi) ResizeVolume(args ResizeVolumeArgs, reply *Ack) (err error) {
+	defer observeRpc("ResizeVolume", time.Now(), &err)
+	size, err := parseSize(args.Size)
+	if err != nil {
+		return err
+	}
+	return ack(reply, api.Driver.resizeVolume(args.Volume, size))
 }
 
-func (api RpcApi) RemoveVolume(args []string, result *string) error {
-	purge, err := strconv.ParseBool(args[1])
+func (api RpcApi) RemoveVolume(args RemoveVolumeArgs, reply *Ack) (err error) {
+	defer observeRpc("RemoveVolume", time.Now(), &err)
+	return ack(reply, api.Driver.removeVolume(args.Volume, args.Purge, args.Force))
+}
+
+func (api RpcApi) ImportVolume(args ImportVolumeArgs, reply *Ack) (err error) {
+	defer observeRpc("ImportVolume", time.Now(), &err)
+	mountpoint, err := api.Driver.config.resolveMountpoint(args.Volume, args.Mountpoint, "")
 	if err != nil {
 		return err
 	}
-	return api.Driver.removeVolume(args[0], purge)
+	return ack(reply, api.Driver.importVolume(args.Volume, mountpoint, args.File))
 }
 
-func (api RpcApi) CreateSnap(args []string, result *string) error {
-	return api.Driver.createSnap(args[0], args[1])
+func (api RpcApi) ClearMounts(args VolumeArgs, reply *Ack) (err error) {
+	defer observeRpc("ClearMounts", time.Now(), &err)
+	return ack(reply, api.Driver.clearMounts(args.Volume))
 }
 
-func (api RpcApi) ListSnapshots(args []string, result *string) error {
-	snaps, err := api.Driver.listSnapshots(args[0])
+func (api RpcApi) ListVolumes(args VolumeArgs, reply *VolumeList) (err error) {
+	defer observeRpc("ListVolumes", time.Now(), &err)
+	reply.Volumes = api.Driver.volumeInfos()
+	return nil
+}
+
+func (api RpcApi) VolumePath(args VolumeArgs, reply *PathReply) (err error) {
+	defer observeRpc("VolumePath", time.Now(), &err)
+	volumePath, err := api.Driver.getVolumePath(args.Volume)
 	if err != nil {
 		return err
 	}
 
-	if len(snaps) > 0 {
-		*result = strings.Join(snaps, "\n") + "\n"
+	reply.Path = volumePath + "/current"
+	return nil
+}
+
+func (api RpcApi) VolumeInfo(args VolumeArgs, reply *VolumeInfo) (err error) {
+	defer observeRpc("VolumeInfo", time.Now(), &err)
+	info, err := api.Driver.volumeInfo(args.Volume)
+	if err != nil {
+		return err
 	}
 
+	*reply = info
 	return nil
 }
 
-func (api RpcApi) RemoveSnap(args []string, result *string) error {
-	return api.Driver.removeSnap(args[0], args[1])
+func (api RpcApi) Recover(args RecoverArgs, reply *RecoveryReport) (err error) {
+	defer observeRpc("Recover", time.Now(), &err)
+	report, err := api.Driver.Recover(args.Root, args.DryRun)
+	*reply = report
+	return err
 }
 
-func (api RpcApi) RestoreSnap(args []string, result *string) error {
-	return api.Driver.restoreSnap(args[0], args[1])
+func (api RpcApi) CreateSnap(args CreateSnapArgs, reply *Ack) (err error) {
+	defer observeRpc("CreateSnap", time.Now(), &err)
+	if err := validateSnapshotName(args.Snapshot); err != nil {
+		return err
+	}
+	labels, err := parseLabels(args.Labels)
+	if err != nil {
+		return err
+	}
+	meta := SnapshotMeta{Description: args.Description, Labels: labels, Creator: creatorCli}
+	return ack(reply, api.Driver.createSnap(args.Volume, args.Snapshot, meta))
 }
 
+func (api RpcApi) CreateGroupSnap(args CreateGroupSnapArgs, reply *Ack) (err error) {
+	defer observeRpc("CreateGroupSnap", time.Now(), &err)
+	if err := validateSnapshotName(args.Snapshot); err != nil {
+		return err
+	}
+	labels, err := parseLabels(args.Labels)
+	if err != nil {
+		return err
+	}
+	meta := SnapshotMeta{Description: args.Description, Labels: labels, Creator: creatorCli}
+	return ack(reply, api.Driver.createGroupSnap(args.Group, args.Volumes, args.Snapshot, meta))
+}
+
+func (api RpcApi) ListSnapshots(args ListSnapshotsArgs, reply *SnapshotList) (err error) {
+	defer observeRpc("ListSnapshots", time.Now(), &err)
+	labels, err := parseLabels(args.Labels)
+	if err != nil {
+		return err
+	}
+	filter := SnapshotFilter{Since: args.Since, Until: args.Until, Labels: labels}
+
+	snaps, err := api.Driver.snapshotInfos(args.Volume)
+	if err != nil {
+		return err
+	}
+
+	for _, snap := range snaps {
+		if filter.matches(snap) {
+			reply.Snapshots = append(reply.Snapshots, snap)
+		}
+	}
+	return sortSnapshotInfos(reply.Snapshots, args.Sort, args.Reverse)
+}
+
+func (api RpcApi) RemoveSnap(args SnapshotArgs, reply *Ack) (err error) {
+	defer observeRpc("RemoveSnap", time.Now(), &err)
+	if err := validateSnapshotName(args.Snapshot); err != nil {
+		return err
+	}
+	return ack(reply, api.Driver.removeSnap(args.Volume, args.Snapshot))
+}
+
+func (api RpcApi) DiffSnaps(args DiffSnapsArgs, reply *DiffReport) (err error) {
+	defer observeRpc("DiffSnaps", time.Now(), &err)
+	for _, name := range []string{args.From, args.To} {
+		if name == diffCurrent {
+			continue
+		}
+		if err := validateSnapshotName(name); err != nil {
+			return err
+		}
+	}
+	report, err := api.Driver.diffSnapshots(args.Volume, args.From, args.To)
+	if err != nil {
+		return err
+	}
+	*reply = report
+	return nil
+}
+
+func (api RpcApi) RestoreSnap(args RestoreSnapArgs, reply *Ack) (err error) {
+	defer observeRpc("RestoreSnap", time.Now(), &err)
+	if err := validateSnapshotName(args.Snapshot); err != nil {
+		return err
+	}
+	return ack(reply, api.Driver.restoreSnap(args.Volume, args.Snapshot, args.Force, args.NoBackup))
+}
+
+func (api RpcApi) RestoreGroupSnap(args RestoreGroupSnapArgs, reply *Ack) (err error) {
+	defer observeRpc("RestoreGroupSnap", time.Now(), &err)
+	if err := validateSnapshotName(args.Snapshot); err != nil {
+		return err
+	}
+	return ack(reply, api.Driver.restoreGroupSnap(args.Group, args.Snapshot, args.Force, args.NoBackup))
+}
+
+func (api RpcApi) RestorePath(args RestorePathArgs, reply *Ack) (err error) {
+	defer observeRpc("RestorePath", time.Now(), &err)
+	if err := validateSnapshotName(args.Snapshot); err != nil {
+		return err
+	}
+	return ack(reply, api.Driver.restorePath(args.Volume, args.Snapshot, args.Path, args.Dest, args.Overwrite))
+}
+
+func (api RpcApi) BrowseSnap(args BrowseSnapArgs, reply *BrowseReply) (err error) {
+	defer observeRpc("BrowseSnap", time.Now(), &err)
+	if err := validateSnapshotName(args.Snapshot); err != nil {
+		return err
+	}
+	listing, err := api.Driver.browseSnapshot(args.Volume, args.Snapshot, args.Path)
+	if err != nil {
+		return err
+	}
+	*reply = listing
+	return nil
+}
+
+func (api RpcApi) SendSnap(args SendSnapArgs, reply *Ack) (err error) {
+	defer observeRpc("SendSnap", time.Now(), &err)
+	if err := validateSnapshotName(args.Snapshot); err != nil {
+		return err
+	}
+	return ack(reply, api.Driver.sendSnap(args.Volume, args.Snapshot, args.TargetDir))
+}
+
+func (api RpcApi) ExportSnap(args ExportSnapArgs, reply *Ack) (err error) {
+	defer observeRpc("ExportSnap", time.Now(), &err)
+	if err := validateSnapshotName(args.Snapshot); err != nil {
+		return err
+	}
+	return ack(reply, api.Driver.exportSnap(args.Volume, args.Snapshot, args.File, args.Compress))
+}
+
+func (api RpcApi) ImportSnap(args ImportSnapArgs, reply *Ack) (err error) {
+	defer observeRpc("ImportSnap", time.Now(), &err)
+	if err := validateOptionalSnapshotName(args.Snapshot); err != nil {
+		return err
+	}
+	return ack(reply, api.Driver.importSnap(args.Volume, args.File, args.Snapshot))
+}
+
+// validateOptionalSnapshotName checks an optional snapshot name, empty names select
+// the default of the call, e.g. the current state or the name in the stream.
+func validateOptionalSnapshotName(name string) error {
+	if name == "" {
+		return nil
+	}
+	return validateSnapshotName(name)
+}
+
+func ack(reply *Ack, err error) error {
+	reply.Ok = err == nil
+	return err
+}
+
+// LegacyRpcApi answers calls of CLIs from before the typed protocol, which
+// would otherwise fail with obscure decoding errors.
+type LegacyRpcApi struct{}
+
+var errLegacyClient = errors.New(fmt.Sprintf("this CLI is too old for the daemon (protocol version %d), please update it", ProtocolVersion))
+
+func (api LegacyRpcApi) CreateVolume(args []string, result *string) error  { return errLegacyClient }
+func (api LegacyRpcApi) RemoveVolume(args []string, result *string) error  { return errLegacyClient }
+func (api LegacyRpcApi) CreateSnap(args []string, result *string) error    { return errLegacyClient }
+func (api LegacyRpcApi) ListSnapshots(args []string, result *string) error { return errLegacyClient }
+func (api LegacyRpcApi) RemoveSnap(args []string, result *string) error    { return errLegacyClient }
+func (api LegacyRpcApi) RestoreSnap(args []string, result *string) error   { return errLegacyClient }
+
 type RpcApiRequest struct {
 	Method string
-	Args   []string
+	Args   interface{}
+	Reply  interface{}
+}
+
+func newRequest(method string, args interface{}, reply interface{}) RpcApiRequest {
+	return RpcApiRequest{RpcServiceName + "." + method, args, reply}
+}
+
+func HandshakeRequest() RpcApiRequest {
+	return newRequest("Handshake", HandshakeArgs{ProtocolVersion}, &HandshakeReply{})
+}
+
+func CreateVolumeRequest(volume string, path string, root string, size string) RpcApiRequest {
+	return newRequest("CreateVolume", CreateVolumeArgs{volume, path, root, size}, &Ack{})
+}
+
+func CloneVolumeRequest(srcVolume string, snapshot string, volume string, path string, root string) RpcApiRequest {
+	return newRequest("CloneVolume", CloneVolumeArgs{srcVolume, snapshot, volume, path, root}, &Ack{})
+}
+
+func ResizeVolumeRequest(volume string, size string) RpcApiRequest {
+	return newRequest("ResizeVolume", ResizeVolumeArgs{volume, size}, &Ack{})
+}
+
+func RemoveVolumeRequest(volume string, purge bool, force bool) RpcApiRequest {
+	return newRequest("RemoveVolume", RemoveVolumeArgs{volume, purge, force}, &Ack{})
 }
 
-func CreateVolumeRequest(volume string, path string) RpcApiRequest {
-	return RpcApiRequest{"RpcApi.CreateVolume", []string{volume, path}}
+func ImportVolumeRequest(volume string, path string, file string) RpcApiRequest {
+	return newRequest("ImportVolume", ImportVolumeArgs{volume, path, file}, &Ack{})
 }
 
-func RemoveVolumeRequest(volume string, purge bool) RpcApiRequest {
-	return RpcApiRequest{"RpcApi.RemoveVolume", []string{volume, fmt.Sprintf("%v", purge)}}
+func ClearMountsRequest(volume string) RpcApiRequest {
+	return newRequest("ClearMounts", VolumeArgs{volume}, &Ack{})
 }
 
-func CreateSnapRequest(volume string, snapname string) RpcApiRequest {
-	return RpcApiRequest{"RpcApi.CreateSnap", []string{volume, snapname}}
+func ListVolumesRequest() RpcApiRequest {
+	return newRequest("ListVolumes", VolumeArgs{}, &VolumeList{})
 }
 
-func ListSnapshotsRequest(volume string) RpcApiRequest {
-	return RpcApiRequest{"RpcApi.ListSnapshots", []string{volume}}
+func VolumePathRequest(volume string) RpcApiRequest {
+	return newRequest("VolumePath", VolumeArgs{volume}, &PathReply{})
+}
+
+func VolumeInfoRequest(volume string) RpcApiRequest {
+	return newRequest("VolumeInfo", VolumeArgs{volume}, &VolumeInfo{})
+}
+
+func RecoverRequest(root string, dryRun bool) RpcApiRequest {
+	return newRequest("Recover", RecoverArgs{root, dryRun}, &RecoveryReport{})
+}
+
+func CreateSnapRequest(volume string, snapname string, description string, labels []string) RpcApiRequest {
+	return newRequest("CreateSnap", CreateSnapArgs{volume, snapname, description, labels}, &Ack{})
+}
+
+func CreateGroupSnapRequest(group string, volumes []string, snapname string, description string, labels []string) RpcApiRequest {
+	return newRequest("CreateGroupSnap", CreateGroupSnapArgs{group, volumes, snapname, description, labels}, &Ack{})
+}
+
+func ListSnapshotsRequest(volume string, since *time.Time, until *time.Time, labels []string, sort string, reverse bool) RpcApiRequest {
+	return newRequest("ListSnapshots", ListSnapshotsArgs{volume, since, until, labels, sort, reverse}, &SnapshotList{})
 }
 
 func RemoveSnapRequest(volume string, snapshot string) RpcApiRequest {
-	return RpcApiRequest{"RpcApi.RemoveSnap", []string{volume, snapshot}}
+	return newRequest("RemoveSnap", SnapshotArgs{volume, snapshot}, &Ack{})
+}
+
+func DiffSnapsRequest(volume string, from string, to string) RpcApiRequest {
+	return newRequest("DiffSnaps", DiffSnapsArgs{volume, from, to}, &DiffReport{})
+}
+
+func RestoreSnapRequest(volume string, snapshot string, force bool, noBackup bool) RpcApiRequest {
+	return newRequest("RestoreSnap", RestoreSnapArgs{volume, snapshot, force, noBackup}, &Ack{})
+}
+
+func RestoreGroupSnapRequest(group string, snapshot string, force bool, noBackup bool) RpcApiRequest {
+	return newRequest("RestoreGroupSnap", RestoreGroupSnapArgs{group, snapshot, force, noBackup}, &Ack{})
+}
+
+func RestorePathRequest(volume string, snapshot string, p string, dest string, overwrite bool) RpcApiRequest {
+	return newRequest("RestorePath", RestorePathArgs{volume, snapshot, p, dest, overwrite}, &Ack{})
+}
+
+func BrowseSnapRequest(volume string, snapshot string, p string) RpcApiRequest {
+	return newRequest("BrowseSnap", BrowseSnapArgs{volume, snapshot, p}, &BrowseReply{})
+}
+
+func SendSnapRequest(volume string, snapshot string, targetDir string) RpcApiRequest {
+	return newRequest("SendSnap", SendSnapArgs{volume, snapshot, targetDir}, &Ack{})
+}
+
+func ExportSnapRequest(volume string, snapshot string, file string, compress bool) RpcApiRequest {
+	return newRequest("ExportSnap", ExportSnapArgs{volume, snapshot, file, compress}, &Ack{})
 }
 
-func RestoreSnapRequest(volume string, snapshot string) RpcApiRequest {
-	return RpcApiRequest{"RpcApi.RestoreSnap", []string{volume, snapshot}}
+func ImportSnapRequest(volume string, file string, snapshot string) RpcApiRequest {
+	return newRequest("ImportSnap", ImportSnapArgs{volume, file, snapshot}, &Ack{})
 }
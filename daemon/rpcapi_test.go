@@ -0,0 +1,178 @@
+package daemon
+
+import (
+	"net"
+	"net/rpc"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRpcClient(t *testing.T) *rpc.Client {
+	client, _, _ := newTestRpcClientWithDriver(t)
+	return client
+}
+
+func newTestRpcClientWithDriver(t *testing.T) (*rpc.Client, LocalBtrfsDriver, func()) {
+	driver, cleanup := newTestDriver(t)
+
+	server := rpc.NewServer()
+	if err := server.RegisterName(RpcServiceName, RpcApi{Driver: driver}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.RegisterName("RpcApi", LegacyRpcApi{}); err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	return rpc.NewClient(clientConn), driver, cleanup
+}
+
+func TestHandshake(t *testing.T) {
+	client := newTestRpcClient(t)
+	defer client.Close()
+
+	request := HandshakeRequest()
+	if err := client.Call(request.Method, request.Args, request.Reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckProtocolVersion(*request.Reply.(*HandshakeReply)); err != nil {
+		t.Error("Handshake with matching version should succeed:", err)
+	}
+
+	err := CheckProtocolVersion(HandshakeReply{ProtocolVersion + 1})
+	if err == nil || !strings.Contains(err.Error(), "protocol version mismatch") {
+		t.Error("Handshake with other version should fail, got", err)
+	}
+}
+
+func TestLegacyClientGetsClearError(t *testing.T) {
+	client := newTestRpcClient(t)
+	defer client.Close()
+
+	result := new(string)
+	err := client.Call("RpcApi.CreateVolume", []string{"volume"}, &result)
+	if err == nil || err.Error() != errLegacyClient.Error() {
+		t.Error("Legacy call should fail with a clear error, got", err)
+	}
+}
+
+func TestTypedRequestReturnsDriverError(t *testing.T) {
+	client := newTestRpcClient(t)
+	defer client.Close()
+
+	request := ListSnapshotsRequest("unknown", nil, nil, nil, "", false)
+	err := client.Call(request.Method, request.Args, request.Reply)
+	if err == nil || err.Error() != "volume unknown does not exist" {
+		t.Error("Should fail for unknown volume, got", err)
+	}
+}
+
+func TestRpcSnapshotLifecycle(t *testing.T) {
+	client, driver, cleanup := newTestRpcClientWithDriver(t)
+	defer cleanup()
+	defer client.Close()
+	defer cleanupHelper(driver, t, defaultTestName, defaultTestMountpoint)
+
+	call := func(request RpcApiRequest) {
+		if err := client.Call(request.Method, request.Args, request.Reply); err != nil {
+			t.Fatalf("%v failed: %v", request.Method, err)
+		}
+	}
+
+	call(CreateVolumeRequest(defaultTestName, defaultTestMountpoint, "", ""))
+	call(CreateSnapRequest(defaultTestName, "snap1", "", nil))
+
+	list := ListSnapshotsRequest(defaultTestName, nil, nil, nil, "", false)
+	call(list)
+	snaps := list.Reply.(*SnapshotList).Snapshots
+	if len(snaps) != 1 || snaps[0].Name != "snap1" || !snaps[0].ReadOnly || snaps[0].CreationTime == nil {
+		t.Errorf("Unexpected snapshots %+v", snaps)
+	}
+
+	info := VolumeInfoRequest(defaultTestName)
+	call(info)
+	if reply := info.Reply.(*VolumeInfo); !reply.Exists || reply.Snapshots != 1 || reply.LatestSnapshot != "snap1" {
+		t.Errorf("Unexpected volume info %+v", reply)
+	}
+
+	call(RemoveSnapRequest(defaultTestName, "snap1"))
+	if _, err := os.Stat(defaultTestMountpoint + "/snaps/snap1"); !os.IsNotExist(err) {
+		t.Error("Snapshot should be removed")
+	}
+}
+
+func TestRpcListSnapshots_filtersAndSorts(t *testing.T) {
+	client, driver, cleanup := newTestRpcClientWithDriver(t)
+	defer cleanup()
+	defer client.Close()
+	defer cleanupHelper(driver, t, defaultTestName, defaultTestMountpoint)
+
+	call := func(request RpcApiRequest) {
+		if err := client.Call(request.Method, request.Args, request.Reply); err != nil {
+			t.Fatalf("%v failed: %v", request.Method, err)
+		}
+	}
+
+	call(CreateVolumeRequest(defaultTestName, defaultTestMountpoint, "", ""))
+	call(CreateSnapRequest(defaultTestName, "b", "before upgrade", []string{"app=web"}))
+	call(CreateSnapRequest(defaultTestName, "a", "", []string{"app=db"}))
+
+	list := ListSnapshotsRequest(defaultTestName, nil, nil, []string{"app=web"}, "", false)
+	call(list)
+	snaps := list.Reply.(*SnapshotList).Snapshots
+	if len(snaps) != 1 || snaps[0].Name != "b" || snaps[0].Description != "before upgrade" || snaps[0].Creator != creatorCli {
+		t.Errorf("Unexpected snapshots %+v", snaps)
+	}
+
+	list = ListSnapshotsRequest(defaultTestName, nil, nil, nil, "name", true)
+	call(list)
+	if snaps := list.Reply.(*SnapshotList).Snapshots; len(snaps) != 2 || snaps[0].Name != "b" {
+		t.Errorf("Expected snapshots in reverse order, got %+v", snaps)
+	}
+
+	future := time.Now().Add(time.Hour)
+	list = ListSnapshotsRequest(defaultTestName, &future, nil, nil, "", false)
+	call(list)
+	if snaps := list.Reply.(*SnapshotList).Snapshots; len(snaps) != 0 {
+		t.Errorf("Expected no snapshots since %v, got %+v", future, snaps)
+	}
+
+	if err := client.Call("LocalBtrfs.CreateSnap", CreateSnapArgs{Volume: defaultTestName, Snapshot: "c", Labels: []string{"invalid"}}, &Ack{}); err == nil {
+		t.Error("Expected error for invalid label")
+	}
+}
+
+func TestRpcRejectsInvalidSnapshotNames(t *testing.T) {
+	client, driver, cleanup := newTestRpcClientWithDriver(t)
+	defer cleanup()
+	defer client.Close()
+	defer cleanupHelper(driver, t, defaultTestName, defaultTestMountpoint)
+
+	request := CreateVolumeRequest(defaultTestName, defaultTestMountpoint, "", "")
+	if err := client.Call(request.Method, request.Args, request.Reply); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, request := range []RpcApiRequest{
+		CloneVolumeRequest(defaultTestName, "..", "clone", "", ""),
+		CreateSnapRequest(defaultTestName, "..", "", nil),
+		CreateGroupSnapRequest("app", []string{defaultTestName}, "..", "", nil),
+		RemoveSnapRequest(defaultTestName, ".."),
+		DiffSnapsRequest(defaultTestName, "..", "current"),
+		RestoreSnapRequest(defaultTestName, "..", false, false),
+		RestoreGroupSnapRequest("app", "..", false, false),
+		RestorePathRequest(defaultTestName, "..", "current", "", false),
+		BrowseSnapRequest(defaultTestName, "..", "/"),
+		SendSnapRequest(defaultTestName, "..", os.TempDir()),
+		ExportSnapRequest(defaultTestName, "..", os.TempDir()+"/export", false),
+		ImportSnapRequest(defaultTestName, os.TempDir()+"/export", "../.."),
+	} {
+		err := client.Call(request.Method, request.Args, request.Reply)
+		if err == nil || !strings.Contains(err.Error(), "invalid snapshot name") {
+			t.Errorf("%v should reject the snapshot name, got %v", request.Method, err)
+		}
+	}
+}
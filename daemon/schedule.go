@@ -0,0 +1,218 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	scheduledSnapPrefix = "auto-"
+	scheduledSnapFormat = "20060102-150405"
+)
+
+// SnapshotSchedule configures automatic snapshots of a volume. Only
+// snapshots taken by the scheduler are ever pruned.
+type SnapshotSchedule struct {
+	Interval    time.Duration `json:"interval,omitempty"`
+	KeepHourly  int           `json:"keepHourly,omitempty"`
+	KeepDaily   int           `json:"keepDaily,omitempty"`
+	KeepWeekly  int           `json:"keepWeekly,omitempty"`
+	KeepMonthly int           `json:"keepMonthly,omitempty"`
+}
+
+type snapshotScheduler struct {
+	driver LocalBtrfsDriver
+	now    func() time.Time
+}
+
+// parseSchedule reads the schedule from the driver options of a volume. It
+// returns nil if no schedule option is given.
+func parseSchedule(options map[string]string) (*SnapshotSchedule, error) {
+	schedule := SnapshotSchedule{}
+	found := false
+
+	if value, ok := options["snapshot_interval"]; ok {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return nil, errors.New(fmt.Sprintf("invalid snapshot_interval %q", value))
+		}
+		schedule.Interval = interval
+		found = true
+	}
+
+	keeps := map[string]*int{
+		"keep_hourly":  &schedule.KeepHourly,
+		"keep_daily":   &schedule.KeepDaily,
+		"keep_weekly":  &schedule.KeepWeekly,
+		"keep_monthly": &schedule.KeepMonthly,
+	}
+	for option, target := range keeps {
+		value, ok := options[option]
+		if !ok {
+			continue
+		}
+		keep, err := strconv.Atoi(value)
+		if err != nil || keep < 0 {
+			return nil, errors.New(fmt.Sprintf("invalid %s %q", option, value))
+		}
+		*target = keep
+		found = true
+	}
+
+	if !found {
+		return nil, nil
+	}
+	return &schedule, nil
+}
+
+func (schedule SnapshotSchedule) hasRetention() bool {
+	return schedule.KeepHourly > 0 || schedule.KeepDaily > 0 || schedule.KeepWeekly > 0 || schedule.KeepMonthly > 0
+}
+
+func scheduledSnapName(t time.Time) string {
+	return scheduledSnapPrefix + t.UTC().Format(scheduledSnapFormat)
+}
+
+func parseScheduledSnapName(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, scheduledSnapPrefix) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(scheduledSnapFormat, strings.TrimPrefix(name, scheduledSnapPrefix))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+type scheduledSnap struct {
+	name string
+	time time.Time
+}
+
+// scheduledSnaps returns the snapshots taken by the scheduler, newest first.
+func scheduledSnaps(names []string) []scheduledSnap {
+	var snaps []scheduledSnap
+	for _, name := range names {
+		if t, ok := parseScheduledSnapName(name); ok {
+			snaps = append(snaps, scheduledSnap{name, t})
+		}
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].time.After(snaps[j].time) })
+	return snaps
+}
+
+// isSnapshotDue reports whether a new scheduled snapshot has to be taken at now.
+func isSnapshotDue(names []string, schedule SnapshotSchedule, now time.Time) bool {
+	if schedule.Interval <= 0 {
+		return false
+	}
+	snaps := scheduledSnaps(names)
+	if len(snaps) == 0 {
+		return true
+	}
+	return !now.Before(snaps[0].time.Add(schedule.Interval))
+}
+
+// snapshotsToPrune returns the scheduled snapshots that are not kept by any
+// of the keep rules, oldest first. Each rule keeps the newest snapshot of the
+// given number of most recent hours/days/weeks/months that have a snapshot.
+func snapshotsToPrune(names []string, schedule SnapshotSchedule) []string {
+	if !schedule.hasRetention() {
+		return nil
+	}
+
+	rules := []struct {
+		keep   int
+		bucket func(t time.Time) string
+	}{
+		{schedule.KeepHourly, func(t time.Time) string { return t.Format("2006-01-02 15") }},
+		{schedule.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{schedule.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{schedule.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+
+	snaps := scheduledSnaps(names)
+	keep := map[string]bool{}
+	for _, rule := range rules {
+		buckets := map[string]bool{}
+		for _, snap := range snaps {
+			if len(buckets) >= rule.keep {
+				break
+			}
+			bucket := rule.bucket(snap.time)
+			if !buckets[bucket] {
+				buckets[bucket] = true
+				keep[snap.name] = true
+			}
+		}
+	}
+
+	var prune []string
+	for i := len(snaps) - 1; i >= 0; i-- {
+		if !keep[snaps[i].name] {
+			prune = append(prune, snaps[i].name)
+		}
+	}
+	return prune
+}
+
+// StartScheduler checks every tick for volumes with a due snapshot.
+func (driver LocalBtrfsDriver) StartScheduler(tick time.Duration) {
+	scheduler := snapshotScheduler{driver: driver, now: time.Now}
+	go func() {
+		for {
+			scheduler.run()
+			time.Sleep(tick)
+		}
+	}()
+}
+
+func (scheduler snapshotScheduler) run() {
+	driver := scheduler.driver
+
+	driver.mutex.RLock()
+	schedules := map[string]SnapshotSchedule{}
+	for name, schedule := range driver.schedules {
+		schedules[name] = *schedule
+	}
+	driver.mutex.RUnlock()
+
+	for name, schedule := range schedules {
+		if err := scheduler.runVolume(name, schedule); err != nil {
+			logger.With(Fields{"operation": "schedule", "volume": name}).WithError(err).Error("scheduled snapshot failed")
+		}
+	}
+}
+
+func (scheduler snapshotScheduler) runVolume(volumeName string, schedule SnapshotSchedule) error {
+	driver := scheduler.driver
+
+	snaps, err := driver.listSnapshots(volumeName)
+	if err != nil {
+		return err
+	}
+
+	now := scheduler.now()
+	if isSnapshotDue(snaps, schedule, now) {
+		name := scheduledSnapName(now)
+		if err := driver.createSnap(volumeName, name, SnapshotMeta{Created: now, Creator: creatorSchedule}); err != nil {
+			return err
+		}
+		snaps = append(snaps, name)
+	}
+
+	for _, snap := range snapshotsToPrune(snaps, schedule) {
+		if err := driver.removeSnap(volumeName, snap); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package daemon
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (clock *fakeClock) now() time.Time {
+	return clock.t
+}
+
+func (clock *fakeClock) advance(d time.Duration) {
+	clock.t = clock.t.Add(d)
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{time.Date(2017, 3, 1, 0, 30, 0, 0, time.UTC)}
+}
+
+func TestParseSchedule(t *testing.T) {
+	schedule, err := parseSchedule(map[string]string{"mountpoint": "/data"})
+	if err != nil || schedule != nil {
+		t.Error("Should not return a schedule without schedule options")
+	}
+
+	schedule, err = parseSchedule(map[string]string{"snapshot_interval": "1h", "keep_daily": "7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := SnapshotSchedule{Interval: time.Hour, KeepDaily: 7}
+	if *schedule != expected {
+		t.Errorf("Expected %+v, got %+v", expected, *schedule)
+	}
+
+	if _, err := parseSchedule(map[string]string{"snapshot_interval": "hourly"}); err == nil {
+		t.Error("Should fail on invalid interval")
+	}
+	if _, err := parseSchedule(map[string]string{"keep_weekly": "-1"}); err == nil {
+		t.Error("Should fail on negative keep count")
+	}
+}
+
+func TestIsSnapshotDue(t *testing.T) {
+	clock := newFakeClock()
+	schedule := SnapshotSchedule{Interval: time.Hour}
+
+	if !isSnapshotDue([]string{"manual"}, schedule, clock.now()) {
+		t.Error("Snapshot should be due without scheduled snapshots")
+	}
+
+	snaps := []string{scheduledSnapName(clock.now())}
+	clock.advance(59 * time.Minute)
+	if isSnapshotDue(snaps, schedule, clock.now()) {
+		t.Error("Snapshot should not be due before the interval passed")
+	}
+
+	clock.advance(time.Minute)
+	if !isSnapshotDue(snaps, schedule, clock.now()) {
+		t.Error("Snapshot should be due after the interval passed")
+	}
+
+	if isSnapshotDue(nil, SnapshotSchedule{KeepDaily: 1}, clock.now()) {
+		t.Error("Snapshot should never be due without interval")
+	}
+}
+
+func TestSnapshotsToPrune_keepsEverythingWithoutRetention(t *testing.T) {
+	clock := newFakeClock()
+	snaps := []string{scheduledSnapName(clock.now())}
+	clock.advance(time.Hour)
+	snaps = append(snaps, scheduledSnapName(clock.now()))
+
+	if prune := snapshotsToPrune(snaps, SnapshotSchedule{Interval: time.Hour}); len(prune) != 0 {
+		t.Error("Should not prune without keep rules, got", prune)
+	}
+}
+
+func TestSnapshotsToPrune_keepsNewestPerDay(t *testing.T) {
+	clock := newFakeClock()
+	var snaps []string
+	// three days with snapshots every 12 hours
+	for i := 0; i < 6; i++ {
+		snaps = append(snaps, scheduledSnapName(clock.now()))
+		clock.advance(12 * time.Hour)
+	}
+	snaps = append(snaps, "manual")
+
+	prune := snapshotsToPrune(snaps, SnapshotSchedule{KeepDaily: 2})
+
+	expected := []string{
+		"auto-20170301-003000",
+		"auto-20170301-123000",
+		"auto-20170302-003000",
+		"auto-20170303-003000",
+	}
+	if !reflect.DeepEqual(expected, prune) {
+		t.Errorf("Expected %v, got %v", expected, prune)
+	}
+}
+
+func TestSnapshotsToPrune_combinesRules(t *testing.T) {
+	clock := newFakeClock()
+	var snaps []string
+	// hourly snapshots over 40 days
+	for i := 0; i < 40*24; i++ {
+		snaps = append(snaps, scheduledSnapName(clock.now()))
+		clock.advance(time.Hour)
+	}
+
+	schedule := SnapshotSchedule{KeepHourly: 24, KeepDaily: 7, KeepWeekly: 4, KeepMonthly: 2}
+	prune := snapshotsToPrune(snaps, schedule)
+
+	pruned := map[string]bool{}
+	for _, name := range prune {
+		pruned[name] = true
+	}
+	var kept []string
+	for _, name := range snaps {
+		if !pruned[name] {
+			kept = append(kept, name)
+		}
+	}
+
+	newest := snaps[len(snaps)-1]
+	if pruned[newest] {
+		t.Error("Newest snapshot should be kept")
+	}
+	// 24 hourly, 6 more daily (one is the newest hourly), 3 more weekly, 1 more monthly
+	if len(kept) != 34 {
+		t.Errorf("Expected 34 kept snapshots, got %d: %v", len(kept), kept)
+	}
+}
+
+// TestScheduler_concurrentCreateRemove is meant to be run with -race.
+func TestScheduler_concurrentCreateRemove(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	clock := newFakeClock()
+	scheduler := snapshotScheduler{driver: driver, now: clock.now}
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 50; i++ {
+			scheduler.run()
+			clock.advance(time.Hour)
+		}
+		close(done)
+	}()
+
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("vol%d", i%5)
+		res := driver.Create(volume.Request{Name: name, Options: map[string]string{
+			"mountpoint":        path.Join(driver.config.StateDir, name),
+			"snapshot_interval": "1h",
+			"hook_timeout":      "1s",
+		}})
+		if res.Err != "" {
+			t.Fatal(res.Err)
+		}
+		driver.List(volume.Request{})
+		driver.Remove(volume.Request{Name: name})
+	}
+	<-done
+}
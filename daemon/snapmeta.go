@@ -0,0 +1,179 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshotMetaFile is kept in the directory of each volume, so the metadata
+// stays with the snapshots when the state file is lost or rebuilt.
+const snapshotMetaFile = "snapshots.json"
+
+// creators of snapshots
+const (
+	creatorCli        = "cli"
+	creatorSchedule   = "schedule"
+	creatorPreRestore = "pre-restore"
+	creatorImport     = "import"
+)
+
+// SnapshotMeta is what the daemon records about a snapshot besides the
+// subvolume itself.
+type SnapshotMeta struct {
+	Created     time.Time         `json:"created"`
+	Description string            `json:"description,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Creator     string            `json:"creator,omitempty"`
+	// Group names the set of snapshots taken together of the volumes in
+	// Members, which all record the same group and members.
+	Group   string   `json:"group,omitempty"`
+	Members []string `json:"members,omitempty"`
+}
+
+// SnapshotFilter selects snapshots by creation time and labels. Empty fields
+// match all snapshots.
+type SnapshotFilter struct {
+	Since  *time.Time
+	Until  *time.Time
+	Labels map[string]string
+}
+
+const (
+	snapshotSortName    = "name"
+	snapshotSortCreated = "created"
+)
+
+var snapshotSortKeys = []string{snapshotSortName, snapshotSortCreated}
+
+func (filter SnapshotFilter) matches(info SnapshotInfo) bool {
+	if filter.Since != nil || filter.Until != nil {
+		if info.CreationTime == nil {
+			return false
+		}
+		if filter.Since != nil && info.CreationTime.Before(*filter.Since) {
+			return false
+		}
+		if filter.Until != nil && info.CreationTime.After(*filter.Until) {
+			return false
+		}
+	}
+	for key, value := range filter.Labels {
+		if actual, ok := info.Labels[key]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// sortSnapshotInfos sorts by name or creation time, snapshots without
+// creation time first.
+func sortSnapshotInfos(infos []SnapshotInfo, key string, reverse bool) error {
+	var less func(a SnapshotInfo, b SnapshotInfo) bool
+	switch key {
+	case "", snapshotSortName:
+		less = func(a SnapshotInfo, b SnapshotInfo) bool { return a.Name < b.Name }
+	case snapshotSortCreated:
+		less = func(a SnapshotInfo, b SnapshotInfo) bool {
+			switch {
+			case a.CreationTime == nil && b.CreationTime == nil:
+				return a.Name < b.Name
+			case a.CreationTime == nil || b.CreationTime == nil:
+				return a.CreationTime == nil
+			case a.CreationTime.Equal(*b.CreationTime):
+				return a.Name < b.Name
+			}
+			return a.CreationTime.Before(*b.CreationTime)
+		}
+	default:
+		return errors.New(fmt.Sprintf("invalid sort key %q, must be one of %v", key, snapshotSortKeys))
+	}
+
+	sort.SliceStable(infos, func(i, j int) bool {
+		if reverse {
+			return less(infos[j], infos[i])
+		}
+		return less(infos[i], infos[j])
+	})
+	return nil
+}
+
+// parseLabels parses labels given as "key=value".
+func parseLabels(labels []string) (map[string]string, error) {
+	parsed := map[string]string{}
+	for _, label := range labels {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New(fmt.Sprintf("invalid label %q, must be key=value", label))
+		}
+		parsed[parts[0]] = parts[1]
+	}
+	return parsed, nil
+}
+
+func readSnapshotMeta(volumePath string) (map[string]SnapshotMeta, error) {
+	meta := map[string]SnapshotMeta{}
+	data, err := ioutil.ReadFile(path.Join(volumePath, snapshotMetaFile))
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// writeSnapshotMeta replaces the metadata file of the volume atomically.
+func writeSnapshotMeta(volumePath string, meta map[string]SnapshotMeta) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	p := path.Join(volumePath, snapshotMetaFile)
+	tmp := p + stateTempSuffix
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// updateSnapshotMeta applies update to the metadata of the volume. Failures
+// are only logged, as the snapshots themselves are fine without metadata.
+func (driver LocalBtrfsDriver) updateSnapshotMeta(volumePath string, update func(meta map[string]SnapshotMeta)) {
+	driver.metaMutex.Lock()
+	defer driver.metaMutex.Unlock()
+
+	meta, err := readSnapshotMeta(volumePath)
+	if err == nil {
+		update(meta)
+		err = writeSnapshotMeta(volumePath, meta)
+	}
+	if err != nil {
+		logger.With(Fields{"path": volumePath}).WithError(err).Warn("could not update snapshot metadata")
+	}
+}
+
+func (driver LocalBtrfsDriver) recordSnapshot(volumePath string, snapshotName string, meta SnapshotMeta) {
+	if meta.Created.IsZero() {
+		meta.Created = time.Now()
+	}
+	driver.updateSnapshotMeta(volumePath, func(all map[string]SnapshotMeta) {
+		all[snapshotName] = meta
+	})
+}
+
+func (driver LocalBtrfsDriver) forgetSnapshot(volumePath string, snapshotName string) {
+	driver.updateSnapshotMeta(volumePath, func(all map[string]SnapshotMeta) {
+		delete(all, snapshotName)
+	})
+}
@@ -0,0 +1,123 @@
+package daemon
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshotFilter(t *testing.T) {
+	t1 := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	snap := SnapshotInfo{Name: "snap", CreationTime: &t1, Labels: map[string]string{"app": "web", "env": "prod"}}
+
+	filters := []struct {
+		filter  SnapshotFilter
+		matches bool
+	}{
+		{SnapshotFilter{}, true},
+		{SnapshotFilter{Since: &t1}, true},
+		{SnapshotFilter{Since: &t2}, false},
+		{SnapshotFilter{Until: &t1}, true},
+		{SnapshotFilter{Labels: map[string]string{"app": "web"}}, true},
+		{SnapshotFilter{Labels: map[string]string{"app": "web", "env": "test"}}, false},
+		{SnapshotFilter{Labels: map[string]string{"missing": ""}}, false},
+	}
+	for _, f := range filters {
+		if actual := f.filter.matches(snap); actual != f.matches {
+			t.Errorf("Expected %v for filter %+v, got %v", f.matches, f.filter, actual)
+		}
+	}
+
+	if (SnapshotFilter{Since: &t1}).matches(SnapshotInfo{Name: "unknown"}) {
+		t.Error("Snapshots without creation time should not match time filters")
+	}
+}
+
+func TestSortSnapshotInfos(t *testing.T) {
+	t1 := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	infos := []SnapshotInfo{
+		{Name: "a", CreationTime: &t2},
+		{Name: "b"},
+		{Name: "c", CreationTime: &t1},
+	}
+
+	names := func() []string {
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name)
+		}
+		return names
+	}
+
+	if err := sortSnapshotInfos(infos, "created", false); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"b", "c", "a"}; !reflect.DeepEqual(names(), expected) {
+		t.Errorf("Expected %v, got %v", expected, names())
+	}
+
+	sortSnapshotInfos(infos, "name", true)
+	if expected := []string{"c", "b", "a"}; !reflect.DeepEqual(names(), expected) {
+		t.Errorf("Expected %v, got %v", expected, names())
+	}
+
+	if err := sortSnapshotInfos(infos, "size", false); err == nil {
+		t.Error("Expected error for invalid sort key")
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := parseLabels([]string{"app=web", "note=a=b", "empty="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"app": "web", "note": "a=b", "empty": ""}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Errorf("Expected %v, got %v", expected, labels)
+	}
+
+	for _, invalid := range []string{"app", "=web"} {
+		if _, err := parseLabels([]string{invalid}); err == nil {
+			t.Errorf("Expected error for label %q", invalid)
+		}
+	}
+}
+
+func TestSnapshotMetadata(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	defaultCreateHelper(driver, t)
+	defer defaultCleanupHelper(driver, t)
+
+	meta := SnapshotMeta{Description: "before upgrade", Labels: map[string]string{"app": "web"}, Creator: creatorCli}
+	if err := driver.createSnap(defaultTestName, "snap1", meta); err != nil {
+		t.Fatal(err)
+	}
+	driver.createSnap(defaultTestName, "snap2", SnapshotMeta{})
+
+	infos, err := driver.snapshotInfos(defaultTestName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("Expected 2 snapshots, got %+v", infos)
+	}
+	if infos[0].Description != "before upgrade" || infos[0].Creator != creatorCli || infos[0].Labels["app"] != "web" || infos[0].CreationTime == nil {
+		t.Errorf("Unexpected metadata %+v", infos[0])
+	}
+
+	// the metadata is gone with the snapshot
+	if err := driver.removeSnap(defaultTestName, "snap1"); err != nil {
+		t.Fatal(err)
+	}
+	recorded, err := readSnapshotMeta(defaultTestMountpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := recorded["snap1"]; ok || len(recorded) != 1 {
+		t.Errorf("Expected only metadata of snap2, got %v", recorded)
+	}
+}
@@ -0,0 +1,147 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// snapshotVolumeSeparator joins the names of a volume and one of its
+// snapshots to the name of a read-only volume with the contents of the
+// snapshot, e.g. "data@before-upgrade". Volume names can't contain it.
+const snapshotVolumeSeparator = "@"
+
+func snapshotVolumeName(volumeName string, snapshotName string) string {
+	return volumeName + snapshotVolumeSeparator + snapshotName
+}
+
+// splitSnapshotVolume returns the volume and snapshot of a snapshot volume
+// name, ok is false for other names.
+func splitSnapshotVolume(name string) (volumeName string, snapshotName string, ok bool) {
+	i := strings.Index(name, snapshotVolumeSeparator)
+	if i <= 0 || i == len(name)-1 {
+		return "", "", false
+	}
+	return name[:i], name[i+1:], true
+}
+
+// mountPath returns the directory containers see for a volume or a snapshot
+// volume. Snapshots are read-only subvolumes, so writes fail with EROFS.
+func (driver LocalBtrfsDriver) mountPath(name string) (string, error) {
+	driver.mutex.RLock()
+	defer driver.mutex.RUnlock()
+	return driver.mountPathLocked(name)
+}
+
+// mountPathLocked is mountPath for callers holding the mutex.
+func (driver LocalBtrfsDriver) mountPathLocked(name string) (string, error) {
+	if volumeName, snapshotName, ok := splitSnapshotVolume(name); ok {
+		return driver.existingSnapshotPathLocked(volumeName, snapshotName)
+	}
+	volumePath, err := driver.getVolumePathLocked(name)
+	if err != nil {
+		return "", err
+	}
+	return volumePath + "/current", nil
+}
+
+// snapshotVolume returns the docker volume of a snapshot volume name.
+func (driver LocalBtrfsDriver) snapshotVolume(name string) (*volume.Volume, error) {
+	volumeName, snapshotName, ok := splitSnapshotVolume(name)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%q is no snapshot volume", name))
+	}
+	if _, err := driver.existingSnapshotPath(volumeName, snapshotName); err != nil {
+		return nil, err
+	}
+
+	infos, err := driver.snapshotInfos(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.Name == snapshotName {
+			return driver.snapshotVolumeOf(volumeName, info), nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("snapshot %q does not exist for volume %q", snapshotName, volumeName))
+}
+
+// snapshotVolumes returns the snapshot volumes of all snapshots of all
+// volumes without status, used by List if list_snapshots is set.
+func (driver LocalBtrfsDriver) snapshotVolumes() []*volume.Volume {
+	var volumes []*volume.Volume
+	for _, volumeName := range driver.volumeNames() {
+		volumePath, err := driver.getVolumePath(volumeName)
+		if err != nil {
+			continue
+		}
+		snaps, err := listSnapshotDir(volumeName, volumePath)
+		if err != nil {
+			logger.With(Fields{"volume": volumeName}).WithError(err).Warn("could not list snapshots")
+			continue
+		}
+		for _, snap := range snaps {
+			snapPath, err := driver.getSnapshotPath(volumePath, snap)
+			if err != nil {
+				continue
+			}
+			volumes = append(volumes, &volume.Volume{Name: snapshotVolumeName(volumeName, snap), Mountpoint: snapPath})
+		}
+	}
+	return volumes
+}
+
+func (driver LocalBtrfsDriver) snapshotVolumeOf(volumeName string, info SnapshotInfo) *volume.Volume {
+	name := snapshotVolumeName(volumeName, info.Name)
+	status := map[string]interface{}{
+		"Volume":   volumeName,
+		"Snapshot": info.Name,
+		"ReadOnly": info.ReadOnly,
+		"Mounts":   driver.mountCount(name),
+	}
+	if info.CreationTime != nil {
+		status["CreationTime"] = info.CreationTime.Format(time.RFC3339)
+	}
+	if info.Description != "" {
+		status["Description"] = info.Description
+	}
+
+	return &volume.Volume{
+		Name:       name,
+		Mountpoint: info.Path,
+		Status:     status,
+	}
+}
+
+// removeSnapshotVolume handles the removal of a snapshot volume by docker.
+// Only the snapshot volume is forgotten, neither the snapshot nor its volume
+// are removed, use `snap rm` for that.
+func (driver LocalBtrfsDriver) removeSnapshotVolume(name string) (err error) {
+	defer logOperation("remove-snapshot-volume", Fields{"volume": name}, time.Now(), &err)
+
+	driver.mutex.RLock()
+	defer driver.mutex.RUnlock()
+
+	if err := driver.checkNotMounted(name, false); err != nil {
+		return err
+	}
+	logger.With(Fields{"volume": name}).Info("snapshot volumes are only removed with their snapshot, keeping it")
+	return nil
+}
+
+// checkSnapshotsNotMounted returns an error if containers are using snapshot
+// volumes of the volume, unless force is set. The caller holds the mutex.
+func (driver LocalBtrfsDriver) checkSnapshotsNotMounted(volumeName string, force bool) error {
+	for name := range driver.mounts {
+		if parent, _, ok := splitSnapshotVolume(name); ok && parent == volumeName {
+			if err := driver.checkNotMounted(name, force); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
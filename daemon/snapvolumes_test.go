@@ -0,0 +1,118 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestSplitSnapshotVolume(t *testing.T) {
+	names := map[string][]string{
+		"data@snap1":  {"data", "snap1"},
+		"data@a@b":    {"data", "a@b"},
+		"data":        nil,
+		"@snap1":      nil,
+		"data@":       nil,
+		"data.1@snap": {"data.1", "snap"},
+	}
+	for name, expected := range names {
+		volumeName, snapshotName, ok := splitSnapshotVolume(name)
+		if ok != (expected != nil) || (ok && (volumeName != expected[0] || snapshotName != expected[1])) {
+			t.Errorf("Unexpected split of %q: %q %q %v", name, volumeName, snapshotName, ok)
+		}
+	}
+}
+
+func TestSnapshotVolumes(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	defaultCreateHelper(driver, t)
+	defer defaultCleanupHelper(driver, t)
+
+	ioutil.WriteFile(defaultTestMountpoint+"/current/file", []byte("content"), 0644)
+	driver.createSnap(defaultTestName, "snap", SnapshotMeta{})
+	name := snapshotVolumeName(defaultTestName, "snap")
+	snapPath := defaultTestMountpoint + "/snaps/snap"
+
+	res := driver.Get(volume.Request{Name: name})
+	if res.Err != "" || res.Volume.Mountpoint != snapPath || res.Volume.Status["Volume"] != defaultTestName {
+		t.Fatalf("Unexpected snapshot volume %+v", res)
+	}
+	if res := driver.Get(volume.Request{Name: defaultTestName + "@missing"}); res.Err == "" {
+		t.Error("Expected error for missing snapshot")
+	}
+	if res := driver.Create(volume.Request{Name: name}); res.Err != "" {
+		t.Error("Creating an existing snapshot volume should succeed:", res.Err)
+	}
+
+	if res := driver.Mount(volume.MountRequest{Name: name, ID: "container1"}); res.Err != "" || res.Mountpoint != snapPath {
+		t.Fatalf("Unexpected mount %+v", res)
+	}
+	if res := driver.Path(volume.Request{Name: defaultTestName}); res.Mountpoint != defaultTestMountpoint+"/current" {
+		t.Errorf("Path of the volume should be unchanged, got %v", res.Mountpoint)
+	}
+
+	if len(driver.List(volume.Request{}).Volumes) != 1 {
+		t.Error("Snapshots should only be listed with list_snapshots")
+	}
+	driver.config.ListSnapshots = true
+	if len(driver.List(volume.Request{}).Volumes) != 2 {
+		t.Error("Expected the snapshot volume in the list")
+	}
+
+	// mounts of snapshot volumes survive restarts
+	data := driver.stateData()
+	restarted, cleanupRestarted := newTestDriver(t)
+	defer cleanupRestarted()
+	restarted.loadStateData(data)
+	if restarted.mountCount(name) != 1 {
+		t.Errorf("Expected the mount in the state, got %+v", data.Volumes[defaultTestName])
+	}
+
+	if res := driver.Remove(volume.Request{Name: name}); res.Err == "" {
+		t.Error("Should not remove a mounted snapshot volume")
+	}
+	if err := driver.removeSnap(defaultTestName, "snap"); err == nil {
+		t.Error("Should not remove a mounted snapshot")
+	}
+	if err := driver.removeVolume(defaultTestName, true, false); err == nil {
+		t.Error("Should not purge a volume with mounted snapshots")
+	}
+
+	driver.Unmount(volume.UnmountRequest{Name: name, ID: "container1"})
+	if res := driver.Remove(volume.Request{Name: name}); res.Err != "" {
+		t.Fatal(res.Err)
+	}
+	if !driver.exists(defaultTestName) {
+		t.Error("Removing a snapshot volume should keep its volume")
+	}
+	if _, err := driver.existingSnapshotPath(defaultTestName, "snap"); err != nil {
+		t.Error("Removing a snapshot volume should keep the snapshot:", err)
+	}
+}
+
+func TestSnapshotVolumes_invalidSnapshotName(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	defaultCreateHelper(driver, t)
+	defer defaultCleanupHelper(driver, t)
+
+	for _, snapshotName := range []string{"..", "../..", "../../..", "x/../.."} {
+		name := snapshotVolumeName(defaultTestName, snapshotName)
+		if res := driver.Mount(volume.MountRequest{Name: name, ID: "container1"}); res.Err == "" {
+			t.Errorf("Mount of %q should fail, got %+v", name, res)
+		}
+		if res := driver.Path(volume.Request{Name: name}); res.Err == "" {
+			t.Errorf("Path of %q should fail, got %+v", name, res)
+		}
+		if res := driver.Get(volume.Request{Name: name}); res.Err == "" {
+			t.Errorf("Get of %q should fail, got %+v", name, res)
+		}
+	}
+	if driver.mountCount(snapshotVolumeName(defaultTestName, "..")) != 0 {
+		t.Error("Failed mounts should not be recorded")
+	}
+}
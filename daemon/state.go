@@ -0,0 +1,221 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+const (
+	// stateVersion is the current version of the state file format:
+	//   1 (no version field): {"state": {name: mountpoint}, "schedules": ..., "sizes": ..., "mounts": ...}
+	//   2: {"version": 2, "volumes": {name: volumeRecord}}
+	stateVersion = 2
+
+	stateBackupSuffix = ".bak"
+	stateTempSuffix   = ".tmp"
+)
+
+type stateData struct {
+	Version int                      `json:"version"`
+	Volumes map[string]*volumeRecord `json:"volumes"`
+}
+
+// volumeRecord is everything the daemon knows about a volume.
+type volumeRecord struct {
+	Mountpoint string            `json:"mountpoint"`
+	Schedule   *SnapshotSchedule `json:"schedule,omitempty"`
+	Size       uint64            `json:"size,omitempty"`
+	Mounts     []string          `json:"mounts,omitempty"`
+	Hooks      *SnapshotHooks    `json:"hooks,omitempty"`
+	// SnapshotMounts are the mounts of snapshot volumes by snapshot name.
+	SnapshotMounts map[string][]string `json:"snapshot_mounts,omitempty"`
+}
+
+// legacyStateData is the unversioned state format of version 1.
+type legacyStateData struct {
+	State     map[string]string            `json:"state"`
+	Schedules map[string]*SnapshotSchedule `json:"schedules,omitempty"`
+	Sizes     map[string]uint64            `json:"sizes,omitempty"`
+	Mounts    map[string][]string          `json:"mounts,omitempty"`
+}
+
+func newStateData() stateData {
+	return stateData{
+		Version: stateVersion,
+		Volumes: map[string]*volumeRecord{},
+	}
+}
+
+// readStateFile loads the state file at p. If it is missing or corrupt, the
+// backup of the previous state is used. Only if neither exists an empty state
+// is returned, so a damaged state file never makes the daemon forget volumes.
+func readStateFile(p string) (stateData, error) {
+	data, err := parseStateFile(p)
+	if err == nil {
+		return data, nil
+	}
+
+	backup, backupErr := parseStateFile(p + stateBackupSuffix)
+	if backupErr == nil {
+		logger.With(Fields{"state_file": p}).WithError(err).Warn("could not load state file, using backup")
+		return backup, nil
+	}
+
+	if os.IsNotExist(err) && os.IsNotExist(backupErr) {
+		return newStateData(), nil
+	}
+
+	return stateData{}, err
+}
+
+func parseStateFile(p string) (stateData, error) {
+	fileData, err := ioutil.ReadFile(p)
+	if err != nil {
+		return stateData{}, err
+	}
+
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(fileData, &header); err != nil {
+		return stateData{}, err
+	}
+
+	switch {
+	case header.Version <= 1:
+		var legacy legacyStateData
+		if err := json.Unmarshal(fileData, &legacy); err != nil {
+			return stateData{}, err
+		}
+		if legacy.State == nil {
+			return stateData{}, errors.New(fmt.Sprintf("state file %v contains no state", p))
+		}
+		return migrateLegacyState(legacy), nil
+	case header.Version > stateVersion:
+		return stateData{}, errors.New(fmt.Sprintf("state file %v has version %d, only up to %d is supported", p, header.Version, stateVersion))
+	}
+
+	data := newStateData()
+	if err := json.Unmarshal(fileData, &data); err != nil {
+		return stateData{}, err
+	}
+	if data.Volumes == nil {
+		data.Volumes = map[string]*volumeRecord{}
+	}
+	for name, record := range data.Volumes {
+		if record == nil || record.Mountpoint == "" {
+			return stateData{}, errors.New(fmt.Sprintf("state file %v has no mountpoint for volume %v", p, name))
+		}
+	}
+	data.Version = stateVersion
+
+	return data, nil
+}
+
+func migrateLegacyState(legacy legacyStateData) stateData {
+	data := newStateData()
+	for name, mountpoint := range legacy.State {
+		data.Volumes[name] = &volumeRecord{
+			Mountpoint: mountpoint,
+			Schedule:   legacy.Schedules[name],
+			Size:       legacy.Sizes[name],
+			Mounts:     legacy.Mounts[name],
+		}
+	}
+	return data
+}
+
+// writeStateFile replaces the state file at p atomically. The previous state
+// file is kept as backup.
+func writeStateFile(p string, data stateData) error {
+	fileData, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := p + stateTempSuffix
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(fileData); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(p, p+stateBackupSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return err
+	}
+
+	return syncDir(path.Dir(p))
+}
+
+// syncDir makes renames in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (driver LocalBtrfsDriver) stateData() stateData {
+	data := newStateData()
+	for name, mountpoint := range driver.volumes {
+		data.Volumes[name] = &volumeRecord{
+			Mountpoint: mountpoint,
+			Schedule:   driver.schedules[name],
+			Size:       driver.sizes[name],
+			Mounts:     driver.mounts[name],
+			Hooks:      driver.hooks[name],
+		}
+	}
+	for name, ids := range driver.mounts {
+		volumeName, snapshotName, ok := splitSnapshotVolume(name)
+		if !ok || data.Volumes[volumeName] == nil {
+			continue
+		}
+		record := data.Volumes[volumeName]
+		if record.SnapshotMounts == nil {
+			record.SnapshotMounts = map[string][]string{}
+		}
+		record.SnapshotMounts[snapshotName] = ids
+	}
+	return data
+}
+
+func (driver LocalBtrfsDriver) loadStateData(data stateData) {
+	for name, record := range data.Volumes {
+		driver.volumes[name] = record.Mountpoint
+		if record.Schedule != nil {
+			driver.schedules[name] = record.Schedule
+		}
+		if record.Hooks != nil {
+			driver.hooks[name] = record.Hooks
+		}
+		if record.Size != 0 {
+			driver.sizes[name] = record.Size
+		}
+		if len(record.Mounts) > 0 {
+			driver.mounts[name] = record.Mounts
+		}
+		for snapshotName, ids := range record.SnapshotMounts {
+			driver.mounts[snapshotVolumeName(name, snapshotName)] = ids
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func tempStateFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "local-btrfs-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path.Join(dir, DefaultConfig().StateFile), func() { os.RemoveAll(dir) }
+}
+
+func TestReadStateFile_migratesLegacyFormat(t *testing.T) {
+	p, cleanup := tempStateFile(t)
+	defer cleanup()
+
+	legacy := `{"state":{"vol1":"/btrfs/vol1","vol2":"/btrfs/vol2"},"schedules":{"vol1":{"interval":3600000000000,"keepDaily":7}},"sizes":{"vol2":1024},"mounts":{"vol2":["abc"]}}`
+	if err := ioutil.WriteFile(p, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := readStateFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data.Version != stateVersion || len(data.Volumes) != 2 {
+		t.Fatalf("Unexpected migrated state %+v", data)
+	}
+	vol1 := data.Volumes["vol1"]
+	if vol1.Mountpoint != "/btrfs/vol1" || vol1.Schedule == nil || vol1.Schedule.Interval != time.Hour || vol1.Schedule.KeepDaily != 7 {
+		t.Errorf("Unexpected record for vol1: %+v", vol1)
+	}
+	vol2 := data.Volumes["vol2"]
+	if vol2.Mountpoint != "/btrfs/vol2" || vol2.Size != 1024 || len(vol2.Mounts) != 1 || vol2.Schedule != nil {
+		t.Errorf("Unexpected record for vol2: %+v", vol2)
+	}
+}
+
+func TestWriteStateFile_roundTripsAndKeepsBackup(t *testing.T) {
+	p, cleanup := tempStateFile(t)
+	defer cleanup()
+
+	first := newStateData()
+	first.Volumes["vol1"] = &volumeRecord{Mountpoint: "/btrfs/vol1"}
+	if err := writeStateFile(p, first); err != nil {
+		t.Fatal(err)
+	}
+
+	second := newStateData()
+	second.Volumes["vol2"] = &volumeRecord{Mountpoint: "/btrfs/vol2", Size: 10}
+	if err := writeStateFile(p, second); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := readStateFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Volumes) != 1 || data.Volumes["vol2"] == nil || data.Volumes["vol2"].Size != 10 {
+		t.Errorf("Expected second state, got %+v", data)
+	}
+
+	backup, err := parseStateFile(p + stateBackupSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backup.Volumes) != 1 || backup.Volumes["vol1"] == nil {
+		t.Errorf("Expected first state as backup, got %+v", backup)
+	}
+
+	if _, err := os.Stat(p + stateTempSuffix); !os.IsNotExist(err) {
+		t.Error("Temporary file should not be left behind")
+	}
+}
+
+func TestReadStateFile_fallsBackToBackup(t *testing.T) {
+	p, cleanup := tempStateFile(t)
+	defer cleanup()
+
+	data := newStateData()
+	data.Volumes["vol1"] = &volumeRecord{Mountpoint: "/btrfs/vol1"}
+	writeStateFile(p, data)
+	writeStateFile(p, data)
+
+	// simulate a crash in the middle of a non-atomic write
+	if err := ioutil.WriteFile(p, []byte(`{"version": 2, "volu`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := readStateFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Volumes["vol1"] == nil {
+		t.Errorf("Expected state from backup, got %+v", loaded)
+	}
+}
+
+func TestReadStateFile_failsWithoutUsableState(t *testing.T) {
+	p, cleanup := tempStateFile(t)
+	defer cleanup()
+
+	data, err := readStateFile(p)
+	if err != nil || len(data.Volumes) != 0 {
+		t.Error("Missing state file should result in empty state, got", err)
+	}
+
+	ioutil.WriteFile(p, []byte("garbage"), 0600)
+	if _, err := readStateFile(p); err == nil {
+		t.Error("Corrupt state file without backup should fail")
+	}
+
+	ioutil.WriteFile(p, []byte(`{"version": 99, "volumes": {}}`), 0600)
+	if _, err := readStateFile(p); err == nil {
+		t.Error("State file of a newer version should fail")
+	}
+}
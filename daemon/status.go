@@ -0,0 +1,213 @@
+package daemon
+
+import (
+	"os"
+	"time"
+)
+
+// VolumeInfo describes a volume and the btrfs subvolume backing it. Fields
+// that can't be determined (e.g. sizes if quotas are disabled) are left empty.
+type VolumeInfo struct {
+	Name            string
+	Mountpoint      string
+	CurrentPath     string
+	SnapshotDir     string
+	Exists          bool
+	SubvolumeID     uint64     `json:",omitempty"`
+	CreationTime    *time.Time `json:",omitempty"`
+	ReferencedBytes *uint64    `json:",omitempty"`
+	ExclusiveBytes  *uint64    `json:",omitempty"`
+	SizeLimit       uint64     `json:",omitempty"`
+	Mounts          int
+	Snapshots       int
+	LatestSnapshot  string `json:",omitempty"`
+}
+
+func (driver LocalBtrfsDriver) volumeInfo(volumeName string) (VolumeInfo, error) {
+	volumePath, err := driver.getVolumePath(volumeName)
+	if err != nil {
+		return VolumeInfo{}, err
+	}
+
+	driver.mutex.RLock()
+	sizeLimit := driver.sizes[volumeName]
+	driver.mutex.RUnlock()
+
+	currentPath := volumePath + "/current"
+	info := VolumeInfo{
+		Name:        volumeName,
+		Mountpoint:  volumePath,
+		CurrentPath: currentPath,
+		SnapshotDir: volumePath + "/snaps",
+		SizeLimit:   sizeLimit,
+		Mounts:      driver.mountCount(volumeName),
+	}
+
+	// a volume whose data was removed behind our back is reported, not an error
+	if _, err := os.Stat(currentPath); os.IsNotExist(err) {
+		return info, nil
+	}
+	info.Exists = true
+
+	subvolume, err := driver.backend.ShowSubvolume(currentPath)
+	if err != nil {
+		return info, err
+	}
+	info.SubvolumeID = subvolume.ID
+	info.CreationTime = subvolume.CreationTime
+
+	// qgroup sizes are only available with quotas enabled on the filesystem
+	if qgroups, err := driver.backend.QgroupUsage(currentPath); err == nil {
+		if usage, ok := qgroups[info.SubvolumeID]; ok {
+			info.ReferencedBytes = &usage.Referenced
+			info.ExclusiveBytes = &usage.Exclusive
+		}
+	}
+
+	snaps, err := driver.snapshotInfos(volumeName)
+	if err != nil {
+		return info, err
+	}
+	info.Snapshots = len(snaps)
+
+	var latest time.Time
+	for _, snap := range snaps {
+		if snap.CreationTime == nil {
+			continue
+		}
+		if info.LatestSnapshot == "" || !snap.CreationTime.Before(latest) {
+			latest = *snap.CreationTime
+			info.LatestSnapshot = snap.Name
+		}
+	}
+
+	return info, nil
+}
+
+// volumeInfos returns the info of all volumes sorted by name. Volumes whose
+// subvolume can't be inspected are included with partial info.
+func (driver LocalBtrfsDriver) volumeInfos() []VolumeInfo {
+	names := driver.volumeNames()
+	infos := make([]VolumeInfo, len(names))
+	for i, name := range names {
+		info, err := driver.volumeInfo(name)
+		if err != nil {
+			logger.With(Fields{"volume": name}).WithError(err).Warn("could not determine status")
+		}
+		infos[i] = info
+	}
+	return infos
+}
+
+// SnapshotInfo describes a snapshot of a volume.
+type SnapshotInfo struct {
+	Name            string
+	Path            string
+	CreationTime    *time.Time `json:",omitempty"`
+	ReadOnly        bool
+	UUID            string            `json:",omitempty"`
+	ParentUUID      string            `json:",omitempty"`
+	ReferencedBytes *uint64           `json:",omitempty"`
+	ExclusiveBytes  *uint64           `json:",omitempty"`
+	Description     string            `json:",omitempty"`
+	Labels          map[string]string `json:",omitempty"`
+	Creator         string            `json:",omitempty"`
+	Group           string            `json:",omitempty"`
+}
+
+// snapshotInfos returns the info of all snapshots of the volume sorted by
+// name. The creation time is the recorded one, or the one of the subvolume
+// for snapshots without metadata.
+func (driver LocalBtrfsDriver) snapshotInfos(volumeName string) ([]SnapshotInfo, error) {
+	volumePath, err := driver.getVolumePath(volumeName)
+	if err != nil {
+		return nil, err
+	}
+
+	snaps, err := driver.listSnapshots(volumeName)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := readSnapshotMeta(volumePath)
+	if err != nil {
+		logger.With(Fields{"volume": volumeName}).WithError(err).Warn("could not read snapshot metadata")
+	}
+
+	// one call each for the subvolumes and the sizes of all snapshots, the
+	// latter fails if quotas are disabled
+	subvolumes, err := driver.backend.ShowSubvolumes(volumePath + "/snaps")
+	if err != nil {
+		logger.With(Fields{"volume": volumeName}).WithError(err).Warn("could not list snapshot subvolumes")
+	}
+	qgroups, qgroupErr := driver.backend.QgroupUsage(volumePath)
+
+	infos := make([]SnapshotInfo, len(snaps))
+	for i, snap := range snaps {
+		snapPath, err := driver.getSnapshotPath(volumePath, snap)
+		if err != nil {
+			return nil, err
+		}
+		infos[i] = SnapshotInfo{
+			Name: snap,
+			Path: snapPath,
+		}
+		if m, ok := meta[snap]; ok {
+			created := m.Created
+			infos[i].CreationTime = &created
+			infos[i].Description = m.Description
+			infos[i].Labels = m.Labels
+			infos[i].Creator = m.Creator
+			infos[i].Group = m.Group
+		}
+
+		subvolume, ok := subvolumes[snap]
+		if !ok {
+			continue
+		}
+		if infos[i].CreationTime == nil {
+			infos[i].CreationTime = subvolume.CreationTime
+		}
+		infos[i].ReadOnly = subvolume.ReadOnly
+		infos[i].UUID = subvolume.UUID
+		infos[i].ParentUUID = subvolume.ParentUUID
+
+		if qgroupErr != nil {
+			continue
+		}
+		if usage, ok := qgroups[subvolume.ID]; ok {
+			infos[i].ReferencedBytes = &usage.Referenced
+			infos[i].ExclusiveBytes = &usage.Exclusive
+		}
+	}
+
+	return infos, nil
+}
+
+// status converts the info to the Status map of a docker volume.
+func (info VolumeInfo) status() map[string]interface{} {
+	status := map[string]interface{}{
+		"Exists":    info.Exists,
+		"Mounts":    info.Mounts,
+		"Snapshots": info.Snapshots,
+	}
+	if info.SubvolumeID != 0 {
+		status["SubvolumeID"] = info.SubvolumeID
+	}
+	if info.CreationTime != nil {
+		status["CreationTime"] = info.CreationTime.Format(time.RFC3339)
+	}
+	if info.ReferencedBytes != nil {
+		status["ReferencedBytes"] = *info.ReferencedBytes
+	}
+	if info.ExclusiveBytes != nil {
+		status["ExclusiveBytes"] = *info.ExclusiveBytes
+	}
+	if info.SizeLimit != 0 {
+		status["SizeLimit"] = info.SizeLimit
+	}
+	if info.LatestSnapshot != "" {
+		status["LatestSnapshot"] = info.LatestSnapshot
+	}
+	return status
+}
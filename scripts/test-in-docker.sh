@@ -6,6 +6,12 @@ dd if=/dev/zero of=/btrfs.img bs=1M count=0 seek=100
 mkfs.btrfs /btrfs.img
 mount -o loop /btrfs.img /btrfs
 
+# second filesystem as target for snapshot send/receive
+dd if=/dev/zero of=/btrfs-backup.img bs=1M count=0 seek=100
+mkfs.btrfs /btrfs-backup.img
+mkdir -p /btrfs-backup
+mount -o loop /btrfs-backup.img /btrfs-backup
+
 make binaries
 
 PKGS=$(find . -type f -name '*.go' | sed -r 's|/[^/]+$||' |sort |uniq | grep -v "^./vendor")
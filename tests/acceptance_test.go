@@ -1,6 +1,7 @@
 package tests
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
@@ -13,8 +14,9 @@ import (
 )
 
 const (
-	cli     = "../bin/linux/amd64/local-btrfs"
-	datadir = "/btrfs/acceptance"
+	cli       = "../bin/linux/amd64/local-btrfs"
+	datadir   = "/btrfs/acceptance"
+	backupdir = "/btrfs-backup/acceptance"
 )
 
 var (
@@ -146,6 +148,56 @@ func Test_snapLs_listsSnapshots(t *testing.T) {
 	assert.Equal(t, "snap1\nsnap2\n", result)
 }
 
+func Test_snapLs_filtersByLabel(t *testing.T) {
+	defer stopDaemon(startDaemon())
+	volume := createVolume()
+	defer removeVolume(volume)
+
+	run("snap", "add", "-m", "before upgrade", "-l", "app=web", volume, "snap1")
+	run("snap", "add", volume, "snap2")
+
+	assert.Equal(t, "snap1\n", run("snap", "ls", "-l", "app=web", volume))
+	assert.Equal(t, "snap2\nsnap1\n", run("snap", "ls", "--sort", "created", "--reverse", volume))
+	assert.Contains(t, run("--output", "table", "snap", "ls", volume), "before upgrade")
+}
+
+func Test_snapDiff_listsChangedPaths(t *testing.T) {
+	defer stopDaemon(startDaemon())
+	volume := createVolume()
+	defer removeVolume(volume)
+
+	ioutil.WriteFile(currentPath(volume)+"/kept", []byte("kept"), 0644)
+	ioutil.WriteFile(currentPath(volume)+"/removed", []byte("removed"), 0644)
+	run("snap", "add", volume, "snap")
+
+	ioutil.WriteFile(currentPath(volume)+"/added", []byte("new"), 0644)
+	removeFile(currentPath(volume) + "/removed")
+
+	assert.Equal(t, "A added 3\nD removed 7\n", run("snap", "diff", volume, "snap"))
+	assert.Contains(t, run("--output", "json", "snap", "diff", volume, "snap", "current"), `"Change": "added"`)
+}
+
+func Test_snapRestorePath_restoresSingleFile(t *testing.T) {
+	defer stopDaemon(startDaemon())
+	volume := createVolume()
+	defer removeVolume(volume)
+
+	ioutil.WriteFile(currentPath(volume)+"/config", []byte("config"), 0644)
+	ioutil.WriteFile(currentPath(volume)+"/data", []byte("old data"), 0644)
+	run("snap", "add", volume, "snap")
+
+	removeFile(currentPath(volume) + "/config")
+	ioutil.WriteFile(currentPath(volume)+"/data", []byte("new data"), 0644)
+
+	assert.Equal(t, "config\ndata\n", run("snap", "browse", volume, "snap"))
+	run("snap", "restore-path", volume, "snap", "/config")
+
+	actual, _ := ioutil.ReadFile(currentPath(volume) + "/config")
+	assert.Equal(t, "config", string(actual))
+	actual, _ = ioutil.ReadFile(currentPath(volume) + "/data")
+	assert.Equal(t, "new data", string(actual))
+}
+
 func removeFile(path string) {
 	if err := os.Remove(path); err != nil {
 		panic(err.Error())
@@ -184,4 +236,191 @@ func Test_snapRestore_restoresSnapshots(t *testing.T) {
 		t.Fatal("could not read file")
 	}
 	assert.Equal(t, content, actual)
+
+	snaps := strings.Fields(run("snap", "ls", volume))
+	assert.Len(t, snaps, 2)
+	assert.True(t, strings.HasPrefix(snaps[0], "pre-restore-"), "expected pre-restore snapshot, got %v", snaps)
+}
+
+func Test_snapRestore_withoutBackup(t *testing.T) {
+	defer stopDaemon(startDaemon())
+	volume := createVolume()
+	defer removeVolume(volume)
+
+	run("snap", "add", volume, "snap")
+	run("snap", "restore", "--no-backup", volume, "snap")
+
+	assert.Equal(t, "snap\n", run("snap", "ls", volume))
+}
+
+func Test_snapSend_sendsSnapshots_incrementally(t *testing.T) {
+	defer stopDaemon(startDaemon())
+	volume := createVolume()
+	defer removeVolume(volume)
+
+	target := backupdir + "/" + volume
+	if err := os.MkdirAll(target, 0700); err != nil {
+		t.Fatal("could not create target directory")
+	}
+
+	ioutil.WriteFile(currentPath(volume)+"/file1", []byte("first"), 0644)
+	run("snap", "add", volume, "snap1")
+	run("snap", "send", volume, "snap1", target)
+
+	ioutil.WriteFile(currentPath(volume)+"/file2", []byte("second"), 0644)
+	run("snap", "add", volume, "snap2")
+	run("snap", "send", volume, "snap2", target)
+
+	actual, err := ioutil.ReadFile(target + "/snap2/file2")
+	if err != nil {
+		t.Fatal("could not read sent file")
+	}
+	assert.Equal(t, []byte("second"), actual)
+	assert.True(t, fileExists(target+"/snap1/file1"))
+}
+
+func Test_snapExport_volumeImport_restoresContent(t *testing.T) {
+	defer stopDaemon(startDaemon())
+	volume := createVolume()
+	defer removeVolume(volume)
+
+	content := []byte("Some content")
+	ioutil.WriteFile(currentPath(volume)+"/someFile", content, 0644)
+	run("snap", "add", volume, "snap")
+
+	file := datadir + "/" + volume + ".btrfs.gz"
+	defer os.Remove(file)
+	run("snap", "export", "--compress", volume, "snap", file)
+
+	imported := newVolName()
+	defer removeVolume(imported)
+	run("volume", "import", imported, volumePath(imported), file)
+
+	actual, err := ioutil.ReadFile(currentPath(imported) + "/someFile")
+	if err != nil {
+		t.Fatal("could not read imported file")
+	}
+	assert.Equal(t, content, actual)
+	assert.Equal(t, "snap\n", run("snap", "ls", imported))
+}
+
+func Test_inspect_showsSnapshots(t *testing.T) {
+	defer stopDaemon(startDaemon())
+	volume := createVolume()
+	defer removeVolume(volume)
+
+	run("snap", "add", volume, "snap1")
+	run("snap", "add", volume, "snap2")
+	result := run("--output", "json", "inspect", volume)
+
+	var info map[string]interface{}
+	if err := json.Unmarshal([]byte(result), &info); err != nil {
+		t.Fatal("could not parse info output: ", result)
+	}
+	assert.Equal(t, float64(2), info["Snapshots"])
+	assert.Equal(t, "snap2", info["LatestSnapshot"])
+	assert.Equal(t, volumePath(volume), info["Mountpoint"])
+	assert.Equal(t, currentPath(volume), info["CurrentPath"])
+	assert.Equal(t, true, info["Exists"])
+}
+
+func Test_resize_changesSizeLimit(t *testing.T) {
+	defer stopDaemon(startDaemon())
+	volume := newVolName()
+	run("add", "--size", "10M", volume, volumePath(volume))
+	defer removeVolume(volume)
+
+	assert.Contains(t, run("info", volume), "10485760")
+
+	run("resize", volume, "20M")
+
+	assert.Contains(t, run("info", volume), "20971520")
+}
+
+func Test_snapLs_printsJson(t *testing.T) {
+	defer stopDaemon(startDaemon())
+	volume := createVolume()
+	defer removeVolume(volume)
+
+	assert.Equal(t, "{\n  \"Snapshots\": []\n}\n", run("--output", "json", "snap", "ls", volume))
+
+	run("snap", "add", volume, "snap1")
+	result := run("--output", "json", "snap", "ls", volume)
+
+	var list struct {
+		Snapshots []map[string]interface{}
+	}
+	if err := json.Unmarshal([]byte(result), &list); err != nil {
+		t.Fatal("could not parse snap ls output: ", result)
+	}
+	assert.Equal(t, 1, len(list.Snapshots))
+	assert.Equal(t, "snap1", list.Snapshots[0]["Name"])
+	assert.Equal(t, true, list.Snapshots[0]["ReadOnly"])
+	assert.Contains(t, list.Snapshots[0], "CreationTime")
+}
+
+func Test_ls_listsVolumes(t *testing.T) {
+	defer stopDaemon(startDaemon())
+	volume := createVolume()
+	defer removeVolume(volume)
+
+	assert.Contains(t, strings.Split(run("ls"), "\n"), volume)
+}
+
+func Test_failingCommand_exitsNonZero(t *testing.T) {
+	defer stopDaemon(startDaemon())
+
+	cmd := exec.Command(cli, "snap", "ls", "doesNotExist")
+	output, err := cmd.CombinedOutput()
+
+	assert.Error(t, err)
+	assert.Contains(t, string(output), "volume doesNotExist does not exist")
+}
+
+func Test_path_printsCurrentPath(t *testing.T) {
+	defer stopDaemon(startDaemon())
+	volume := createVolume()
+	defer removeVolume(volume)
+
+	assert.Equal(t, currentPath(volume)+"\n", run("path", volume))
+}
+
+func Test_clone_createsWritableCopyOfSnapshot(t *testing.T) {
+	defer stopDaemon(startDaemon())
+	volume := createVolume()
+	defer removeVolume(volume)
+
+	content := []byte("Some content")
+	ioutil.WriteFile(currentPath(volume)+"/someFile", content, 0644)
+	run("snap", "add", volume, "snap")
+
+	clone := newVolName()
+	defer removeVolume(clone)
+	run("clone", volume, "snap", clone, volumePath(clone))
+
+	actual, err := ioutil.ReadFile(currentPath(clone) + "/someFile")
+	if err != nil {
+		t.Fatal("could not read cloned file")
+	}
+	assert.Equal(t, content, actual)
+
+	// the clone is writable and independent of the source
+	if err := ioutil.WriteFile(currentPath(clone)+"/someFile", []byte("changed"), 0644); err != nil {
+		t.Fatal("could not write to clone")
+	}
+	actual, _ = ioutil.ReadFile(currentPath(volume) + "/someFile")
+	assert.Equal(t, content, actual)
+}
+
+func Test_recover_registersVolumesFoundOnDisk(t *testing.T) {
+	defer stopDaemon(startDaemon())
+	volume := createVolume()
+	defer removeVolume(volume)
+	run("rm", volume)
+
+	assert.Contains(t, run("recover", "--root", datadir, "--dry-run"), "orphaned "+volume+" "+volumePath(volume)+"\n")
+	assert.NotContains(t, strings.Split(run("ls"), "\n"), volume)
+
+	assert.Contains(t, run("recover", "--root", datadir), "orphaned "+volume+" "+volumePath(volume)+" (registered)\n")
+	assert.Contains(t, strings.Split(run("ls"), "\n"), volume)
 }